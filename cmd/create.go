@@ -33,32 +33,57 @@ import (
 	"strings"
 	"time"
 
-	"github.com/cloudevelops/go-foreman"
 	//jenkins "github.com/cloudevelops/go-jenkins" - doesn't exist
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	//"bytes" - not used
 	"bufio"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"regexp"
+	"sort"
 
-	"github.com/cloudevelops/go-powerdns"
+	"github.com/juju/loggo"
 	"github.com/shirou/gopsutil/process"
 	"os"
 )
 
-var p *powerdns.Powerdns
 var d *sql.DB
 var hostFqdn string
 var hostName string
 var domainName string
 var ipAddress string
+var ip6Address string
 
 //var j *jenkins.Jenkins
 var puppetSslError bool
 var puppetCaError bool
-var f *foreman.Foreman
+var f *foremanClient
 var puppetCaRetries = 10
+var foremanPuppetPlugin bool
+var hostAttributes map[string]interface{}
+
+// foremanReferenceAttributes maps host attributes given by name to the
+// foreman resource they are resolved from.
+var foremanReferenceAttributes = map[string]string{
+	"model":           "models",
+	"puppet_proxy":    "smart_proxies",
+	"puppet_ca_proxy": "smart_proxies",
+	"medium":          "media",
+	"ptable":          "ptables",
+	"realm":           "realms",
+	"compute_profile": "compute_profiles",
+}
+
+// foremanPuppetAttributes are the host attributes the foreman_puppet plugin
+// takes under puppet_attributes.
+var foremanPuppetAttributes = map[string]bool{
+	"environment_id":     true,
+	"puppet_proxy_id":    true,
+	"puppet_ca_proxy_id": true,
+}
 
 // createCmd represents the create command
 var createCmd = &cobra.Command{
@@ -66,13 +91,60 @@ var createCmd = &cobra.Command{
 	Short: "Create a new stackconf host",
 	Long:  `Create a new stackconf host.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Debugf("Create command: starting, version 0.1.27")
+		log.Debugf("Create command: starting, version " + stackconfVersion)
 		if noop {
 			log.Debugf("NOOP ENABLED! This create run will not do any changes.")
 		}
 		stackconfTimeStart := time.Now()
 		//Foreman prototype
-		f = foreman.NewForeman(viper.GetString("foreman.config.host"), viper.GetString("foreman.config.username"), viper.GetString("foreman.config.password"))
+		var err error
+		f, err = newForeman()
+		if err != nil {
+			log.Errorf("Foreman client failed: " + err.Error())
+			return
+		}
+		if !noop && viper.GetBool("foreman.config.report") {
+			stackconfReport = newRunReport()
+			loggo.RegisterWriter("report", reportWriter{})
+		}
+		// Record the run in foreman at the end, even on failure
+		var stackconfCompleted bool
+		var hostCreated bool
+		var stackconfFailure string
+		var puppetExitCodes []string
+		stackconfParameters := make(map[string]string)
+		defer func() {
+			stackconfTimeStop := time.Now()
+			stackconfStatus := "success"
+			if !stackconfCompleted {
+				stackconfStatus = "failed"
+				stackconfReport.failStep("Stackconf run aborted !")
+			} else if stackconfFailure != "" {
+				stackconfStatus = "failed"
+			}
+			if stackconfStatus == "failed" {
+				exitCode = 1
+			}
+			// parameters belong to the host created by this run
+			if hostCreated {
+				stackconfParameters["stackconf_version"] = stackconfVersion
+				stackconfParameters["stackconf_stackenv"] = stackenv
+				stackconfParameters["stackconf_sources"] = strings.Join(viper.GetStringSlice("stackconf.sources"), ",")
+				stackconfParameters["stackconf_start"] = stackconfTimeStart.UTC().Format(time.RFC3339)
+				stackconfParameters["stackconf_end"] = stackconfTimeStop.UTC().Format(time.RFC3339)
+				stackconfParameters["stackconf_runtime"] = strconv.Itoa(int(stackconfTimeStop.Sub(stackconfTimeStart).Seconds()))
+				stackconfParameters["stackconf_puppet_exitcodes"] = strings.Join(puppetExitCodes, ",")
+				stackconfParameters["stackconf_status"] = stackconfStatus
+				err := foremanUpdateParameters(hostFqdn, stackconfParameters)
+				if err != nil {
+					log.Errorf("Error inserting parameters to foreman: " + err.Error() + " !")
+				}
+			} else if !noop && !onlyDNS {
+				log.Debugf("Host not created by this run, skipping foreman parameters")
+			}
+			foremanSubmitReport(hostFqdn)
+		}()
+		stackconfReport.startStep("Foreman lookup")
 		// Host
 		puppetVersion := viper.GetInt("puppet.version")
 		//spew.Dump(puppetVersion)
@@ -91,18 +163,22 @@ var createCmd = &cobra.Command{
 			log.Debugf("Hostgroup not found !")
 			return
 		}
-		hostGroup, err := f.SearchResource("hostgroups", hostGroupName)
+		hostGroup, err := f.SearchResourceTitle("hostgroups", hostGroupName)
 		var hostGroupId string
 		if err == nil {
 			hostGroupId = strconv.FormatFloat(hostGroup["id"].(float64), 'f', -1, 64)
 			log.Debugf("Hostgroup found, name: " + hostGroupName + "; id: " + hostGroupId)
 		} else {
-			log.Errorf("Hostgroup doesnt exist !")
+			log.Errorf("Hostgroup " + hostGroupName + " lookup failed: " + err.Error())
 			return
 		}
 		// Organization
-		orgLoc := strings.Split(hostGroupName, "/")
-		organizationName := orgLoc[0]
+		organizationName := viper.GetString("foreman.host.organization")
+		if organizationName == "" {
+			log.Debugf("Organization not found in config, trying to set from hostgroup")
+			orgLoc := strings.Split(hostGroupName, "/")
+			organizationName = orgLoc[0]
+		}
 		organization, err := f.SearchResource("organizations", organizationName)
 		var organizationId string
 		if err == nil {
@@ -150,7 +226,8 @@ var createCmd = &cobra.Command{
 			log.Debugf("Puppet Environment not found !")
 			return
 		}
-		puppetEnvironment, err := f.SearchResource("environments", puppetEnvironmentName)
+		foremanPuppetPlugin = foremanDetectPuppetPlugin()
+		puppetEnvironment, err := foremanPuppet().SearchResource("environments", puppetEnvironmentName)
 		var puppetEnvironmentId string
 		if err == nil {
 			puppetEnvironmentId = strconv.FormatFloat(puppetEnvironment["id"].(float64), 'f', -1, 64)
@@ -209,28 +286,45 @@ var createCmd = &cobra.Command{
 			log.Errorf("Operating System doesnt exist !" + operatingSystemName)
 			return
 		}
-		// ipAddress
-		if puppetVersion >= 4 {
-			iface := viper.GetString("facter.interface")
-			if iface != "" {
-				log.Debugf("Set custom interface to fetch ip from: " + iface)
-				ipAddress = viper.GetString("puppetfacter.networking.interfaces." + iface + ".ip")
-				if ipAddress == "" {
-					log.Debugf("Failed to fetch ip from: " + iface + ", defaulting to puppetfacter.networking.ip")
-					ipAddress = viper.GetString("puppetfacter.networking.ip")
-				}
+		// compute resource links host to its openstack instance
+		var computeResourceId string
+		var instanceUuid string
+		computeResourceName := viper.GetString("foreman.host.compute_resource")
+		if computeResourceName != "" {
+			computeResource, err := f.SearchResource("compute_resources", computeResourceName)
+			if err == nil {
+				computeResourceId = strconv.FormatFloat(computeResource["id"].(float64), 'f', -1, 64)
+				log.Debugf("Compute Resource found, name: " + computeResourceName + "; id: " + computeResourceId)
 			} else {
-				ipAddress = viper.GetString("puppetfacter.networking.ip")
+				log.Errorf("Compute Resource doesnt exist !")
+				return
 			}
-		} else {
-			ipAddress = viper.GetString("puppetfacter.ipaddress")
+			instanceUuid = viper.GetString("openstackmeta.uuid")
+			if instanceUuid == "" {
+				log.Errorf("Instance uuid not found in openstack metadata !")
+				return
+			}
+			log.Debugf("Instance uuid: " + instanceUuid)
+		}
+		// attributes
+		hostAttributes, err = foremanHostAttributes()
+		if err != nil {
+			log.Errorf("Host attributes failed: " + err.Error())
+			return
 		}
+		// ipAddress
+		hostIpAddresses(puppetVersion)
 		if ipAddress == "" {
 			log.Debugf("IP Address not found !")
 			return
 		} else {
 			log.Debugf("IP Address: " + ipAddress)
 		}
+		if ip6Address == "" {
+			log.Debugf("IPv6 Address not found")
+		} else {
+			log.Debugf("IPv6 Address: " + ip6Address)
+		}
 		// macAddress
 		var macAddress string
 		if puppetVersion >= 4 {
@@ -245,6 +339,53 @@ var createCmd = &cobra.Command{
 			log.Debugf("Mac Address: " + macAddress)
 		}
 
+		// subnet
+		var subnetId string
+		subnetName := viper.GetString("foreman.host.subnet")
+		if subnetName != "" {
+			subnet, err := f.SearchResource("subnets", subnetName)
+			if err == nil {
+				subnetId = strconv.FormatFloat(subnet["id"].(float64), 'f', -1, 64)
+				log.Debugf("Subnet found, name: " + subnetName + "; id: " + subnetId)
+			} else {
+				log.Errorf("Subnet doesnt exist !")
+				return
+			}
+		} else {
+			subnetId, err = foremanSubnetId(ipAddress)
+			if err == nil {
+				log.Debugf("Subnet found for IP Address: " + ipAddress + "; id: " + subnetId)
+			} else {
+				log.Debugf("Subnet not found for IP Address: " + ipAddress + ", host will be created without subnet")
+			}
+		}
+		var subnet6Id string
+		subnet6Name := viper.GetString("foreman.host.subnet6")
+		if subnet6Name != "" {
+			subnet6, err := f.SearchResource("subnets", subnet6Name)
+			if err == nil {
+				subnet6Id = strconv.FormatFloat(subnet6["id"].(float64), 'f', -1, 64)
+				log.Debugf("IPv6 Subnet found, name: " + subnet6Name + "; id: " + subnet6Id)
+			} else {
+				log.Errorf("IPv6 Subnet doesnt exist !")
+				return
+			}
+		} else if ip6Address != "" {
+			subnet6Id, err = foremanSubnetId(ip6Address)
+			if err == nil {
+				log.Debugf("Subnet found for IPv6 Address: " + ip6Address + "; id: " + subnet6Id)
+			} else {
+				log.Debugf("Subnet not found for IPv6 Address: " + ip6Address + ", host will be created without IPv6 subnet")
+			}
+		}
+
+		// interfaces
+		var interfaces []foremanInterface
+		if puppetVersion >= 4 {
+			interfaces = foremanInterfaces(subnetId, subnet6Id)
+			log.Debugf("Interfaces found: " + strconv.Itoa(len(interfaces)))
+		}
+
 		// If puppet version is 7, then check, whether foreman.host.parameter.puppetserver7 is set.
 		// If it's set, replace default puppet server. Same goes for puppet.
 		if puppetVersion == 7 {
@@ -321,39 +462,80 @@ var createCmd = &cobra.Command{
 		}
 
 		// basic dns must be handled before host creation due to foreman conflicts
+		stackconfReport.startStep("DNS")
 		// Configure DNS
-		dnsHost := viper.GetString("dns.config.host")
-		if dnsHost == "" {
+		if !dnsConfigured() {
 			log.Debugf("DNS host not configure, skipping")
 		} else {
-			log.Debugf("Starting DNS record management for host: " + dnsHost)
-			dnsKey := viper.GetString("dns.config.key")
-			if dnsKey == "" {
-				log.Debugf("DNS key not found !")
+			// Initialize DNS backends
+			err = newDnsBackends()
+			if err != nil {
+				log.Debugf("DNS provider failed: " + err.Error() + " !")
 				return
 			}
-
-			// Initialize powerdns
-			dnsNameservers := viper.GetStringSlice("dns.config.nameservers")
-			p = powerdns.NewPowerdns(dnsHost, dnsKey, dnsNameservers)
+			log.Debugf("Starting DNS record management on backends: " + strings.Join(dnsBackendNames(), ", "))
+			dnsBegin()
 			// All noop is handled inside these methods
-			dnsDeleteRecordHostA()
-			dnsRecordHostA()
-			dnsRecordHostPtr()
+			dnsForTargets("host", nil, func() {
+				dnsEnsureZone(domainName)
+				dnsDeleteRecordHostA()
+				dnsRecordHostA()
+				if ip6Address != "" {
+					dnsRecordHostAAAA()
+				}
+			})
+			dnsForTargets("ptr", nil, func() {
+				dnsRecordHostPtr()
+				if ip6Address != "" {
+					dnsRecordHostPtr6()
+				}
+			})
 			// Lookup for config values and setup records
-			doMetaSliceMap("dns.record.a", dnsRecordA)
-			doMetaSliceMap("dns.record.mya", dnsRecordMyA)
-			doMetaSliceMap("dns.record.cname", dnsRecordCname)
-			doMetaSlice("dns.record.mycname", dnsRecordMyCname)
-			doMetaSlice("dns.record.mypubcname", dnsRecordMyPubCname)
-			doMetaSliceMap("dns.record.roota", dnsRecordRootA)
+			doMetaSliceMap("dns.record.a", dnsTargeted("a", dnsRecordA))
+			doMetaSliceMap("dns.record.mya", dnsTargeted("mya", dnsRecordMyA))
+			doMetaSliceMap("dns.record.cname", dnsTargeted("cname", dnsRecordCname))
+			doMetaSlice("dns.record.mycname", dnsTargetedSlice("mycname", dnsRecordMyCname))
+			doMetaSlice("dns.record.mypubcname", dnsTargetedSlice("mypubcname", dnsRecordMyPubCname))
+			doMetaSliceMap("dns.record.roota", dnsTargeted("roota", dnsRecordRootA))
+			doMetaSliceMap("dns.record.txt", dnsTargeted("txt", dnsRecordTxt))
+			doMetaSliceMap("dns.record.srv", dnsTargeted("srv", dnsRecordSrv))
+			doMetaSliceMap("dns.record.mx", dnsTargeted("mx", dnsRecordMx))
+			doMetaSliceMap("dns.record.caa", dnsTargeted("caa", dnsRecordCaa))
+			err = dnsCommit()
+			if err != nil {
+				stackconfFailure = "failed to apply DNS changes: " + err.Error()
+				log.Errorf("Failed to apply DNS changes: " + err.Error() + " !")
+				stackconfReport.failStep("Failed to apply DNS changes: " + err.Error() + " !")
+			}
+		}
+		if dnsConfigured() && !noop && viper.GetBool("dns.config.verify") {
+			stackconfReport.startStep("DNS propagation")
+			timeout := time.Duration(viper.GetInt("dns.config.verify_timeout")) * time.Second
+			interval := time.Duration(viper.GetInt("dns.config.verify_interval")) * time.Second
+			for _, backend := range dnsBackendNames() {
+				if len(dnsUpdated[backend]) == 0 {
+					continue
+				}
+				dnsUse(backend)
+				err := dnsVerify(dnsVerifyNameservers(), dnsUpdated[backend], timeout, interval)
+				if err != nil {
+					stackconfFailure = "DNS propagation failed on backend " + backend + ": " + err.Error()
+					log.Errorf("DNS propagation failed on backend " + backend + ": " + err.Error() + " !")
+					stackconfReport.failStep("DNS propagation failed on backend " + backend + ": " + err.Error() + " !")
+				} else {
+					log.Debugf("DNS records resolvable on all nameservers of backend " + backend)
+				}
+			}
 		}
 
 		if onlyDNS {
 			log.Debugf("Only DNS was to be managed this run, exiting.")
+			stackconfCompleted = true
 			return
 		}
 
+		stackconfReport.startStep("Foreman host")
+
 		if !noop {
 			err = foremanDelete(hostFqdn)
 			if err != nil {
@@ -389,54 +571,115 @@ var createCmd = &cobra.Command{
 			}
 		}
 
+		// puppet proxy, from host attribute puppet_proxy or the smart proxy of the puppet server
+		puppetProxyId, _ := hostAttributes["puppet_proxy_id"].(string)
+		if puppetProxyId == "" && metaData["puppet.config.server"] != nil {
+			puppetProxyName := metaData["puppet.config.server"].(string)
+			puppetProxy, err := f.SearchResource("smart_proxies", puppetProxyName)
+			if err == nil {
+				puppetProxyId = strconv.FormatFloat(puppetProxy["id"].(float64), 'f', -1, 64)
+				log.Debugf("Puppet proxy found, name: " + puppetProxyName + "; id: " + puppetProxyId)
+			} else {
+				log.Debugf("Puppet proxy not found, name: " + puppetProxyName + ", using hostgroup puppet proxy")
+			}
+		}
+
 		// create host
 		type HostResource struct {
 			HostGroupId         string              `json:"hostgroup_id"`
-			PuppetCaId          string              `json:"puppet_ca_proxy_id"`
+			PuppetCaId          string              `json:"puppet_ca_proxy_id,omitempty"`
+			PuppetProxyId       string              `json:"puppet_proxy_id,omitempty"`
 			LocationId          string              `json:"location_id"`
 			OrganizationId      string              `json:"organization_id"`
-			PuppetEnvironmentId string              `json:"environment_id"`
+			PuppetEnvironmentId string              `json:"environment_id,omitempty"`
+			PuppetAttributes    map[string]string   `json:"puppet_attributes,omitempty"`
 			DomainId            string              `json:"domain_id"`
 			OperatingSystemId   string              `json:"operatingsystem_id"`
 			ArchitectureId      string              `json:"architecture_id"`
+			ComputeResourceId   string              `json:"compute_resource_id,omitempty"`
+			Uuid                string              `json:"uuid,omitempty"`
 			Name                string              `json:"name"`
-			Mac                 string              `json:"mac"`
-			Ip                  string              `json:"ip"`
+			Mac                 string              `json:"mac,omitempty"`
+			Ip                  string              `json:"ip,omitempty"`
+			Ip6                 string              `json:"ip6,omitempty"`
+			SubnetId            string              `json:"subnet_id,omitempty"`
+			Subnet6Id           string              `json:"subnet6_id,omitempty"`
 			Build               bool                `json:"build"`
 			Parameters          []map[string]string `json:"host_parameters_attributes"`
+			Interfaces          []foremanInterface  `json:"interfaces_attributes,omitempty"`
 		}
 		type HostMap map[string]HostResource
 
+		hostIpAddress, hostMacAddress, hostSubnetId := ipAddress, macAddress, subnetId
+		hostIp6Address, hostSubnet6Id := ip6Address, subnet6Id
+		if len(interfaces) > 0 {
+			// primary interface carries ip, mac and subnet
+			hostIpAddress, hostMacAddress, hostSubnetId = "", "", ""
+			hostIp6Address, hostSubnet6Id = "", ""
+		}
+		// foreman_puppet plugin moves environment and puppet proxies under puppet attributes
+		hostPuppetEnvironmentId, hostPuppetCaId, hostPuppetProxyId := puppetEnvironmentId, puppetCaId, puppetProxyId
+		var puppetAttributes map[string]string
+		if foremanPuppetPlugin {
+			puppetAttributes = map[string]string{"environment_id": puppetEnvironmentId, "puppet_ca_proxy_id": puppetCaId}
+			if puppetProxyId != "" {
+				puppetAttributes["puppet_proxy_id"] = puppetProxyId
+			}
+			hostPuppetEnvironmentId, hostPuppetCaId, hostPuppetProxyId = "", "", ""
+		}
 		//var hostMap map[string]HostResource
 		hostMap := make(HostMap)
 		hostMap["host"] = HostResource{
 			HostGroupId:         hostGroupId,
-			PuppetCaId:          puppetCaId,
+			PuppetCaId:          hostPuppetCaId,
+			PuppetProxyId:       hostPuppetProxyId,
 			LocationId:          locationId,
 			OrganizationId:      organizationId,
-			PuppetEnvironmentId: puppetEnvironmentId,
+			PuppetEnvironmentId: hostPuppetEnvironmentId,
+			PuppetAttributes:    puppetAttributes,
 			DomainId:            domainId,
 			OperatingSystemId:   operatingSystemId,
 			ArchitectureId:      architectureId,
+			ComputeResourceId:   computeResourceId,
+			Uuid:                instanceUuid,
 			Name:                hostName,
-			Mac:                 macAddress,
-			Ip:                  ipAddress,
+			Mac:                 hostMacAddress,
+			Ip:                  hostIpAddress,
+			Ip6:                 hostIp6Address,
+			SubnetId:            hostSubnetId,
+			Subnet6Id:           hostSubnet6Id,
 			Build:               false,
 			Parameters:          parameters,
+			Interfaces:          interfaces,
 		}
 		jsonText, err := json.Marshal(hostMap)
+		if len(hostAttributes) > 0 {
+			jsonText, err = mergeHostAttributes(jsonText, hostAttributes)
+			if err != nil {
+				log.Errorf("Failed to merge host attributes !")
+				return
+			}
+		}
 		if !noop {
 			data, err := foremanCreate(jsonText)
 			if err != nil {
 				log.Errorf("Failed to create host in foreman !")
 				return
 			}
+			hostCreated = true
 			hostId := strconv.FormatFloat(data["id"].(float64), 'f', 0, 64)
 			log.Debugf("Host created, id: " + hostId)
+			if viper.GetBool("foreman.config.upload_facts") {
+				err = foremanUploadFacts(hostFqdn)
+				if err != nil {
+					log.Errorf("Failed to upload facts to foreman: " + err.Error())
+				}
+			}
 		}
 		log.Debugf("Host created (a sample, non-existing, noop host")
 
 		// Configure SQL
+		stackconfReport.startStep("MySQL")
 		doMetaSliceMap("mysql.record", mySqlRecord)
 		// Configure Jenkins
 		//doMetaSliceMap("jenkins.job", jenkinsJob)
@@ -467,6 +710,8 @@ var createCmd = &cobra.Command{
 			log.Debugf("Puppet will run in server mode with server: " + puppetServer)
 			puppetParam = []string{"agent", "-tv", "--no-use_srv_records", "--ca_server", puppetCaName, "--server", puppetServer}
 		}
+		stackconfReport.endStep()
+		puppetTimeStart := time.Now()
 		// Enable Puppet
 		log.Debugf("Enabling puppet")
 		var puppetExecutable string
@@ -476,7 +721,6 @@ var createCmd = &cobra.Command{
 			puppetExecutable = "/usr/bin/puppet"
 		}
 
-		stackconfParameters := make(map[string]string)
 		if !noop {
 			puppetEnabler := exec.Command(puppetExecutable, "agent", "--enable")
 			c := make(chan struct{})
@@ -497,6 +741,7 @@ var createCmd = &cobra.Command{
 			for r := 1; r <= puppetRuns; r++ {
 				runCount := strconv.Itoa(r)
 				log.Debugf("Running puppet, run #" + runCount)
+				stackconfReport.startStep("Puppet run #" + runCount)
 
 				cmd := exec.Command(puppetExecutable, puppetParam...)
 				c := make(chan struct{})
@@ -512,23 +757,32 @@ var createCmd = &cobra.Command{
 				select {
 				case <-time.After(time.Duration(puppetRunTimeout) * time.Second):
 					log.Debugf("Puppet run timeout reached, killing puppet !")
+					stackconfReport.failStep("Puppet run timeout reached !")
+					puppetExitCodes = append(puppetExitCodes, "timeout")
 					cmd.Process.Kill()
 					killPuppet()
 				case res := <-c1:
 					if res != nil {
-						if exitError, ok := err.(*exec.ExitError); ok {
+						if exitError, ok := res.(*exec.ExitError); ok {
+							puppetExitCodes = append(puppetExitCodes, strconv.Itoa(exitError.ExitCode()))
 							switch exitError.ExitCode() {
 							case 1:
 								log.Debugf("Puppet did not run and ended with error, code 1 !")
+								stackconfReport.failStep("Puppet did not run and ended with error, code 1 !")
 							case 2:
 								log.Debugf("Puppet run succeeded, and some resources were changed, code 2 !")
 							case 4:
 								log.Debugf("Puppet run succeeded, and some resources failed, code 4 !")
+								stackconfReport.failStep("Puppet run succeeded, and some resources failed, code 4 !")
 							case 6:
 								log.Debugf("Puppet run succeeded, and included both changes and failures, code 6 !")
+								stackconfReport.failStep("Puppet run succeeded, and included both changes and failures, code 6 !")
 							default:
 								log.Debugf("Puppet ended up with unknown error, code " + strconv.Itoa(exitError.ExitCode()))
+								stackconfReport.failStep("Puppet ended up with unknown error, code " + strconv.Itoa(exitError.ExitCode()))
 							}
+						} else {
+							puppetExitCodes = append(puppetExitCodes, "error")
 						}
 						if puppetSslError {
 							log.Debugf("Puppet SSL Error detected !")
@@ -564,6 +818,7 @@ var createCmd = &cobra.Command{
 						}
 					} else {
 						log.Debugf("Puppet run succeeded, no changes to system are required, code 0 !")
+						puppetExitCodes = append(puppetExitCodes, "0")
 						r = puppetRuns + 1
 					}
 				}
@@ -589,20 +844,41 @@ var createCmd = &cobra.Command{
 				}
 				stackconfTimeString = stackconfTimeString + v + delimiter
 			}
+			stackconfReport.endStep()
 			stackconfParameters["stackconf_puppet_runtime"] = stackconfTimeString
-			//strconv.Itoa(puppetRunTime)
-			err = foremanUpdateParameters(hostFqdn, stackconfParameters)
-			if err != nil {
-				log.Debugf("Error inserting parameters to foreman !")
-			}
 		} else {
 			log.Debugf("Stackconf would have ran puppet and tested certificates")
 		}
-		stackconfTimeStop := time.Now()
-		stackconfTime := stackconfTimeStop.Sub(stackconfTimeStart)
-		stackconfTimeSeconds := int(stackconfTime.Seconds())
-		stackconfParameters["stackconf_runtime"] = strconv.Itoa(stackconfTimeSeconds)
 
+		// Outcome is based on the last puppet run, or on foreman host status if verified
+		var puppetFailure string
+		if len(puppetExitCodes) > 0 {
+			lastExitCode := puppetExitCodes[len(puppetExitCodes)-1]
+			if lastExitCode != "0" && lastExitCode != "2" {
+				puppetFailure = "last puppet run exit code " + lastExitCode
+			}
+		}
+		if !noop && viper.GetBool("foreman.config.verify_status") {
+			stackconfReport.startStep("Foreman status")
+			statusLabel, err := foremanVerifyStatus(hostFqdn, puppetTimeStart)
+			if err != nil {
+				stackconfFailure = err.Error()
+				stackconfReport.failStep("Foreman host status failed: " + stackconfFailure)
+			} else {
+				puppetFailure = ""
+				log.Debugf("Foreman host status verified: " + statusLabel)
+			}
+			stackconfReport.endStep()
+		}
+		if stackconfFailure == "" {
+			stackconfFailure = puppetFailure
+		}
+
+		stackconfCompleted = true
+		if stackconfFailure != "" {
+			log.Errorf("Stackconf run failed: " + stackconfFailure + " !")
+			return
+		}
 		log.Debugf("Stackconf run completed sucessfully !")
 	},
 }
@@ -624,12 +900,14 @@ func runCommand(cmd *exec.Cmd, c chan struct{}) {
 	for scanner.Scan() {
 		m := scanner.Text()
 		fmt.Println("STDOUT:", m)
+		stackconfReport.addLog("notice", m)
 	}
 
 	errScanner := bufio.NewScanner(stderr)
 	for errScanner.Scan() {
 		e := errScanner.Text()
 		fmt.Println("STDERR:", e)
+		stackconfReport.addLog("warning", e)
 
 		if strings.Contains(e, "The certificate retrieved from the master does not match the agent") {
 			puppetSslError = true
@@ -707,9 +985,42 @@ func doMetaSlice(config string, f func(string)) {
 	}
 }
 
+// hostIpAddresses sets ipAddress and ip6Address from facter.
+func hostIpAddresses(puppetVersion int) {
+	if puppetVersion >= 4 {
+		iface := viper.GetString("facter.interface")
+		if iface != "" {
+			log.Debugf("Set custom interface to fetch ip from: " + iface)
+			ipAddress = viper.GetString("puppetfacter.networking.interfaces." + iface + ".ip")
+			if ipAddress == "" {
+				log.Debugf("Failed to fetch ip from: " + iface + ", defaulting to puppetfacter.networking.ip")
+				ipAddress = viper.GetString("puppetfacter.networking.ip")
+			}
+			ip6Address = viper.GetString("puppetfacter.networking.interfaces." + iface + ".ip6")
+		} else {
+			ipAddress = viper.GetString("puppetfacter.networking.ip")
+		}
+		if ip6Address == "" {
+			ip6Address = viper.GetString("puppetfacter.networking.ip6")
+		}
+		// link local addresses are not registered
+		if !globalIp6(ip6Address) {
+			ip6Address = ""
+		}
+	} else {
+		ipAddress = viper.GetString("puppetfacter.ipaddress")
+	}
+}
+
+// globalIp6 reports whether address is an IPv6 address other than link local.
+func globalIp6(address string) bool {
+	ip6 := net.ParseIP(address)
+	return ip6 != nil && ip6.To4() == nil && !ip6.IsLinkLocalUnicast()
+}
+
 func dnsRecordHostA() {
 	if !noop {
-		err := p.UpdateRecord(domainName, "A", hostName, ipAddress, 10)
+		err := dnsUpdate(domainName, "A", hostFqdn+".", ipAddress, dnsTtl("A"))
 		if err != nil {
 			log.Debugf("Failed to update A record, domain: " + domainName + ", content: " + hostName + ", value: " + ipAddress + " !")
 			return
@@ -720,7 +1031,7 @@ func dnsRecordHostA() {
 
 func dnsDeleteRecordHostA() {
 	if !noop {
-		err := p.DeleteRecord(domainName, "A", hostName)
+		err := dnsDelete(domainName, "A", hostFqdn+".")
 		if err != nil {
 			log.Debugf("Failed to delete A record, domain: " + domainName + ", content: " + hostName + " !")
 			return
@@ -729,12 +1040,49 @@ func dnsDeleteRecordHostA() {
 	log.Debugf("Deleted A record, domain: " + domainName + ", content: " + hostName + " !")
 }
 
+func dnsRecordHostAAAA() {
+	if !noop {
+		err := dnsUpdate(domainName, "AAAA", hostFqdn+".", ip6Address, dnsTtl("AAAA"))
+		if err != nil {
+			log.Debugf("Failed to update AAAA record, domain: " + domainName + ", content: " + hostName + ", value: " + ip6Address + " !")
+			return
+		}
+	}
+	log.Debugf("Updated AAAA record, domain: " + domainName + ", content: " + hostName + ", value: " + ip6Address + " !")
+}
+
 func dnsRecordHostPtr() {
-	ipAddressSlice := strings.Split(ipAddress, ".")
-	ptrRecord := ipAddressSlice[3] + "." + ipAddressSlice[2] + "." + ipAddressSlice[1] + "." + ipAddressSlice[0] + ".in-addr.arpa."
-	ptrDomain := ipAddressSlice[2] + "." + ipAddressSlice[1] + "." + ipAddressSlice[0] + ".in-addr.arpa"
+	dnsRecordPtr(ipAddress)
+}
+
+func dnsRecordHostPtr6() {
+	dnsRecordPtr(ip6Address)
+}
+
+func dnsRecordPtr(address string) {
+	ptrRecord, ptrDomain, err := reverseRecord(address)
+	if err != nil {
+		log.Debugf("Failed to build PTR record for " + address + ": " + err.Error() + " !")
+		return
+	}
+	if classRecord, classDomain, ok := reverseClassless(address); ok {
+		// RFC 2317: the parent zone aliases the address into the delegated zone
+		if viper.GetBool("dns.config.reverse.classless_cname") {
+			dnsEnsureZone(ptrDomain)
+			if !noop {
+				err := dnsUpdate(ptrDomain, "CNAME", ptrRecord, classRecord, dnsTtl("CNAME"))
+				if err != nil {
+					log.Debugf("Failed to update CNAME record, domain: " + ptrDomain + ", content: " + ptrRecord + ", value: " + classRecord + " !")
+					return
+				}
+			}
+			log.Debugf("Updated CNAME record, domain: " + ptrDomain + ", content: " + ptrRecord + ", value: " + classRecord + " !")
+		}
+		ptrRecord, ptrDomain = classRecord, classDomain
+	}
+	dnsEnsureZone(ptrDomain)
 	if !noop {
-		err := p.UpdateRec(ptrDomain, "PTR", ptrRecord, hostFqdn+".", 10)
+		err := dnsUpdate(ptrDomain, "PTR", ptrRecord, hostFqdn+".", dnsTtl("PTR"))
 		if err != nil {
 			log.Debugf("Failed to update PTR record, domain: " + ptrDomain + ", content: " + ptrRecord + ", value: " + hostFqdn + " !")
 			return
@@ -744,47 +1092,42 @@ func dnsRecordHostPtr() {
 }
 
 func dnsRecordMyA(hash map[string]interface{}) {
-	for k, v := range hash {
-		pK, err := metaTemplate(k)
+	for _, entry := range dnsRecordEntries("dns.record.mya", "A", hash) {
+		zone, err := dnsRecordZone(entry.name+"."+domainName, entry.zone)
 		if err != nil {
-			log.Debugf("Failed to parse dns.record.a key " + k + " !")
-			return
+			log.Debugf("Invalid dns.record.mya record " + entry.name + ": " + err.Error() + " !")
+			continue
 		}
-		pV, err := metaTemplate(v.(string))
-		if err != nil {
-			log.Debugf("Failed to parse dns.record.a value " + v.(string) + " !")
-			return
+		update := dnsUpdate
+		if entry.member {
+			update = dnsUpdateMember
 		}
 		if !noop {
-			err = p.UpdateRecord(domainName, "A", pK, pV, 10)
+			err := update(zone, "A", entry.name+"."+domainName+".", entry.value, entry.ttl)
 			if err != nil {
-				log.Debugf("Failed to update A record, domain: " + domainName + ", content: " + pK + ", value: " + pV + " !")
+				log.Debugf("Failed to update A record, domain: " + zone + ", content: " + entry.name + ", value: " + entry.value + " !")
 				return
 			}
 		}
-		log.Debugf("Updated A record, domain: " + domainName + ", content: " + pK + ", value: " + pV + " !")
+		log.Debugf("Updated A record, domain: " + zone + ", content: " + entry.name + ", value: " + entry.value + " !")
 	}
 }
 
 func dnsRecordA(hash map[string]interface{}) {
-	for k, v := range hash {
-		pK, err := metaTemplate(k)
+	for _, entry := range dnsRecordEntries("dns.record.a", "A", hash) {
+		pK, pV := entry.name, entry.value
+		pKDomainName, err := dnsRecordZone(pK, entry.zone)
 		if err != nil {
-			log.Debugf("Failed to parse dns.record.a key " + k + " !")
-			return
+			log.Debugf("Invalid dns.record.a record " + pK + ": " + err.Error() + " !")
+			continue
 		}
-		pV, err := metaTemplate(v.(string))
-		if err != nil {
-			log.Debugf("Failed to parse dns.record.a value " + v.(string) + " !")
-			return
+		pKHostName := strings.TrimSuffix(pK, "."+pKDomainName)
+		update := dnsUpdate
+		if entry.member {
+			update = dnsUpdateMember
 		}
-
-		pKSplit := strings.Split(pK, ".")
-		pKHostName := pKSplit[0]
-		pKDomainName := strings.Replace(pK, pKHostName+".", "", -1)
-
 		if !noop {
-			err = p.UpdateRecord(pKDomainName, "A", pKHostName, pV, 10)
+			err := update(pKDomainName, "A", pK+".", pV, entry.ttl)
 			if err != nil {
 				log.Debugf("Failed to update A record, domain: " + pKDomainName + ", content: " + pKHostName + ", value: " + pV + " !")
 				return
@@ -795,25 +1138,19 @@ func dnsRecordA(hash map[string]interface{}) {
 }
 
 func dnsRecordRootA(hash map[string]interface{}) {
-	for k, v := range hash {
-		pK, err := metaTemplate(k)
-		if err != nil {
-			log.Debugf("Failed to parse dns.record.a key " + k + " !")
-			return
-		}
-		pV, err := metaTemplate(v.(string))
-		if err != nil {
-			log.Debugf("Failed to parse dns.record.a value " + v.(string) + " !")
-			return
-		}
-
+	for _, entry := range dnsRecordEntries("dns.record.roota", "A", hash) {
+		pK, pV := entry.name, entry.value
 		//pKSplit := strings.Split(pK, ".")
 		//pKHostName := pKSplit[0]
 		//pKDomainName := strings.Replace(pK, pKHostName+".", "", -1)
 		pKDomainName := pK + "."
 		pKHostName := pK + "."
+		update := dnsUpdate
+		if entry.member {
+			update = dnsUpdateMember
+		}
 		if !noop {
-			err = p.UpdateRec(pKDomainName, "A", pKHostName, pV, 10)
+			err := update(pK, "A", pKHostName, pV, entry.ttl)
 			if err != nil {
 				log.Debugf("Failed to update Root A record, domain: " + pKDomainName + ", content: " + pKHostName + ", value: " + pV + " !")
 				return
@@ -824,24 +1161,17 @@ func dnsRecordRootA(hash map[string]interface{}) {
 }
 
 func dnsRecordCname(hash map[string]interface{}) {
-	for k, v := range hash {
-		pK, err := metaTemplate(k)
+	for _, entry := range dnsRecordEntries("dns.record.cname", "CNAME", hash) {
+		pK, pV := entry.name, entry.value
+		pKDomainName, err := dnsRecordZone(pK, entry.zone)
 		if err != nil {
-			log.Debugf("Failed to parse dns.record.cname key " + k + " !")
-			return
+			log.Debugf("Invalid dns.record.cname record " + pK + ": " + err.Error() + " !")
+			continue
 		}
-		pV, err := metaTemplate(v.(string))
-		if err != nil {
-			log.Debugf("Failed to parse dns.record.cname value " + v.(string) + " !")
-			return
-		}
-
-		pKSplit := strings.Split(pK, ".")
-		pKHostName := pKSplit[0]
-		pKDomainName := strings.Replace(pK, pKHostName+".", "", -1)
+		pKHostName := strings.TrimSuffix(pK, "."+pKDomainName)
 
 		if !noop {
-			err = p.UpdateRecord(pKDomainName, "CNAME", pKHostName, pV+".", 10)
+			err := dnsUpdate(pKDomainName, "CNAME", pK+".", pV+".", entry.ttl)
 			if err != nil {
 				log.Debugf("Failed to update CNAME record, domain: " + pKDomainName + ", content: " + pKHostName + ", value: " + pV + ". !")
 				return
@@ -851,17 +1181,191 @@ func dnsRecordCname(hash map[string]interface{}) {
 	}
 }
 
+func dnsRecordTxt(hash map[string]interface{}) {
+	dnsRecordStructured("dns.record.txt", "TXT", hash)
+}
+
+func dnsRecordSrv(hash map[string]interface{}) {
+	dnsRecordStructured("dns.record.srv", "SRV", hash)
+}
+
+func dnsRecordMx(hash map[string]interface{}) {
+	dnsRecordStructured("dns.record.mx", "MX", hash)
+}
+
+func dnsRecordCaa(hash map[string]interface{}) {
+	dnsRecordStructured("dns.record.caa", "CAA", hash)
+}
+
+// dnsRecordStructured sets a record given by templated fields.
+func dnsRecordStructured(config string, dtype string, hash map[string]interface{}) {
+	entry, ok := dnsStructuredEntry(config, dtype, hash)
+	if !ok {
+		return
+	}
+	update := dnsUpdate
+	if entry.member {
+		update = dnsUpdateMember
+	}
+	if !noop {
+		err := update(entry.zone, dtype, entry.name, entry.value, entry.ttl)
+		if err != nil {
+			log.Debugf("Failed to update " + dtype + " record, domain: " + entry.zone + ", content: " + entry.name + ", value: " + entry.value + " !")
+			return
+		}
+	}
+	log.Debugf("Updated " + dtype + " record, domain: " + entry.zone + ", content: " + entry.name + ", value: " + entry.value + " !")
+}
+
+// dnsStructuredEntry reads a record given by templated fields. Names are
+// relative to the host domain (@ for the domain itself) unless they end with a
+// dot. The zone field overrides the zone holding the record.
+func dnsStructuredEntry(config string, dtype string, hash map[string]interface{}) (entry dnsRecordEntry, ok bool) {
+	fields := make(map[string]string)
+	for k, v := range hash {
+		if k == "backend" {
+			continue
+		}
+		pV, err := metaTemplate(fmt.Sprint(v))
+		if err != nil {
+			log.Debugf("Failed to parse " + config + " " + k + " " + fmt.Sprint(v) + " !")
+			return entry, false
+		}
+		fields[k] = pV
+	}
+	name := fields["name"]
+	if name == "" {
+		log.Debugf("Record name not set in " + config + " !")
+		return entry, false
+	}
+	entry.name = name + "." + domainName + "."
+	if name == "@" {
+		entry.name = domainName + "."
+	} else if strings.HasSuffix(name, ".") {
+		entry.name = name
+	}
+	var err error
+	entry.zone, err = dnsRecordZone(entry.name, fields["zone"])
+	if err != nil {
+		log.Debugf("Invalid " + config + " record " + name + ": " + err.Error() + " !")
+		return entry, false
+	}
+	entry.ttl = dnsTtl(dtype)
+	if fields["ttl"] != "" {
+		entry.ttl, err = strconv.Atoi(fields["ttl"])
+		if err != nil || entry.ttl <= 0 {
+			log.Debugf("Invalid " + config + " ttl " + fields["ttl"] + " !")
+			return entry, false
+		}
+	}
+	if fields["member"] != "" {
+		entry.member, err = strconv.ParseBool(fields["member"])
+		if err != nil {
+			log.Debugf("Invalid " + config + " member " + fields["member"] + " !")
+			return entry, false
+		}
+	}
+	entry.value, err = dnsRecordContent(dtype, fields)
+	if err != nil {
+		log.Debugf("Invalid " + config + " record " + name + ": " + err.Error() + " !")
+		return entry, false
+	}
+	return entry, true
+}
+
+// dnsRecordEntry is a templated dns.record.* entry.
+type dnsRecordEntry struct {
+	name   string
+	value  string
+	ttl    int
+	zone   string
+	member bool
+}
+
+// dnsRecordEntries reads a dns.record.* hash, given either as name: value
+// pairs or as name, value and ttl fields. A ttl field applies to all records
+// of the hash, otherwise the dns.config.ttl of dtype is used. A zone field
+// overrides the zone of all records of the hash, a member field adds the
+// records to their rrsets instead of replacing them.
+func dnsRecordEntries(config string, dtype string, hash map[string]interface{}) (entries []dnsRecordEntry) {
+	ttl := dnsTtl(dtype)
+	if v, ok := hash["ttl"]; ok {
+		pTtl, err := metaTemplate(fmt.Sprint(v))
+		if err != nil {
+			log.Debugf("Failed to parse " + config + " ttl " + fmt.Sprint(v) + " !")
+			return nil
+		}
+		ttl, err = strconv.Atoi(pTtl)
+		if err != nil || ttl <= 0 {
+			log.Debugf("Invalid " + config + " ttl " + pTtl + " !")
+			return nil
+		}
+	}
+	var zone string
+	if v, ok := hash["zone"]; ok {
+		pZone, err := metaTemplate(fmt.Sprint(v))
+		if err != nil {
+			log.Debugf("Failed to parse " + config + " zone " + fmt.Sprint(v) + " !")
+			return nil
+		}
+		zone = pZone
+	}
+	var member bool
+	if v, ok := hash["member"]; ok {
+		pMember, err := metaTemplate(fmt.Sprint(v))
+		if err == nil {
+			member, err = strconv.ParseBool(pMember)
+		}
+		if err != nil {
+			log.Debugf("Invalid " + config + " member " + fmt.Sprint(v) + " !")
+			return nil
+		}
+	}
+	pairs := make(map[string]interface{})
+	if name, ok := hash["name"]; ok {
+		pairs[fmt.Sprint(name)] = hash["value"]
+	} else {
+		for k, v := range hash {
+			if k != "ttl" && k != "zone" && k != "member" && k != "backend" {
+				pairs[k] = v
+			}
+		}
+	}
+	for k, v := range pairs {
+		pK, err := metaTemplate(k)
+		if err != nil {
+			log.Debugf("Failed to parse " + config + " key " + k + " !")
+			return nil
+		}
+		value, ok := v.(string)
+		if !ok {
+			log.Debugf("Value of " + config + " key " + k + " is not a String !")
+			return nil
+		}
+		pV, err := metaTemplate(value)
+		if err != nil {
+			log.Debugf("Failed to parse " + config + " value " + value + " !")
+			return nil
+		}
+		entries = append(entries, dnsRecordEntry{name: pK, value: pV, ttl: ttl, zone: zone, member: member})
+	}
+	return entries
+}
+
 func dnsRecordMyPubCname(s string) {
 	pS, err := metaTemplate(s)
 	if err != nil {
 		log.Debugf("Failed to parse dns.record.mypubcname value " + s + " !")
 		return
 	}
-	pSSplit := strings.Split(pS, ".")
-	pSHostName := pSSplit[0]
-	pSDomainName := strings.Replace(pS, pSHostName+".", "", -1)
+	pSDomainName, err := dnsRecordZone(pS, "")
+	if err != nil {
+		log.Debugf("Invalid dns.record.mypubcname record " + pS + ": " + err.Error() + " !")
+		return
+	}
+	pSHostName := strings.TrimSuffix(pS, "."+pSDomainName)
 	if !noop {
-		err = p.UpdateRecord(pSDomainName, "CNAME", pSHostName, hostFqdn+".", 10)
+		err = dnsUpdate(pSDomainName, "CNAME", pS+".", hostFqdn+".", dnsTtl("CNAME"))
 		if err != nil {
 			log.Debugf("Failed to update CNAME record, domain: " + pSDomainName + ", content: " + pSHostName + ", value: " + hostFqdn + ". !")
 			return
@@ -876,14 +1380,19 @@ func dnsRecordMyCname(s string) {
 		log.Debugf("Failed to parse dns.record.mycname value " + s + " !")
 		return
 	}
+	zone, err := dnsRecordZone(pS+"."+domainName, "")
+	if err != nil {
+		log.Debugf("Invalid dns.record.mycname record " + pS + ": " + err.Error() + " !")
+		return
+	}
 	if !noop {
-		err = p.UpdateRecord(domainName, "CNAME", pS, hostFqdn+".", 10)
+		err = dnsUpdate(zone, "CNAME", pS+"."+domainName+".", hostFqdn+".", dnsTtl("CNAME"))
 		if err != nil {
-			log.Debugf("Failed to update CNAME record, domain: " + domainName + ", content: " + pS + ", value: " + hostFqdn + ". !")
+			log.Debugf("Failed to update CNAME record, domain: " + zone + ", content: " + pS + ", value: " + hostFqdn + ". !")
 			return
 		}
 	}
-	log.Debugf("Updated CNAME record, domain: " + domainName + ", content: " + pS + ", value: " + hostFqdn + ". !")
+	log.Debugf("Updated CNAME record, domain: " + zone + ", content: " + pS + ", value: " + hostFqdn + ". !")
 }
 
 func mySqlRecord(hash map[string]interface{}) {
@@ -1171,6 +1680,352 @@ func foremanCreateDomain(domain string, foremanProxy string) (domain_id string,
 	return domainId, nil
 }
 
+// foremanSubnets caches the foreman subnet list for the run.
+var foremanSubnets []interface{}
+
+func foremanSubnetList() ([]interface{}, error) {
+	if foremanSubnets != nil {
+		return foremanSubnets, nil
+	}
+	data, err := f.Get("subnets?per_page=10000")
+	if err != nil {
+		log.Debugf("Failed to list subnets in foreman !")
+		return nil, err
+	}
+	subnets, ok := data["results"].([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected foreman subnet list")
+	}
+	foremanSubnets = subnets
+	return foremanSubnets, nil
+}
+
+func foremanSubnetId(ip string) (subnetId string, err error) {
+	hostIp := net.ParseIP(ip)
+	if hostIp == nil {
+		return "", errors.New("Invalid IP address: " + ip)
+	}
+	subnets, err := foremanSubnetList()
+	if err != nil {
+		return "", err
+	}
+	// Pick the most specific subnet containing the address
+	bestPrefix := -1
+	for _, v := range subnets {
+		subnet := v.(map[string]interface{})
+		network, _ := subnet["network"].(string)
+		mask, _ := subnet["mask"].(string)
+		subnetIp := net.ParseIP(network)
+		maskIp := net.ParseIP(mask)
+		if subnetIp == nil || maskIp == nil {
+			continue
+		}
+		subnetMask := net.IPMask(maskIp.To16())
+		if subnetIp.To4() != nil {
+			subnetMask = net.IPMask(maskIp.To4())
+		}
+		ipNet := net.IPNet{IP: subnetIp.Mask(subnetMask), Mask: subnetMask}
+		prefix, _ := subnetMask.Size()
+		if ipNet.Contains(hostIp) && prefix > bestPrefix {
+			bestPrefix = prefix
+			subnetId = strconv.FormatFloat(subnet["id"].(float64), 'f', -1, 64)
+		}
+	}
+	if subnetId == "" {
+		return "", errors.New("Subnet not found for IP address: " + ip)
+	}
+	return subnetId, nil
+}
+
+func foremanUploadFacts(host string) error {
+	if facterData == nil {
+		return errors.New("facts not gathered")
+	}
+	facts := make(map[string]interface{}, len(facterData)+1)
+	for k, v := range facterData {
+		facts[k] = v
+	}
+	facts["_type"] = "puppet"
+	upload := map[string]interface{}{
+		"name":     host,
+		"certname": host,
+		"facts":    facts,
+	}
+	jsonText, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	_, err = f.Post("hosts/facts", jsonText)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Facts uploaded to foreman, host: " + host)
+	return nil
+}
+
+// foremanVerifyStatus waits for a report newer than since and returns the
+// host status labels, failing when the host status is an error.
+func foremanVerifyStatus(host string, since time.Time) (string, error) {
+	timeout := time.Duration(viper.GetInt("foreman.config.verify_timeout")) * time.Second
+	interval := time.Duration(viper.GetInt("foreman.config.verify_interval")) * time.Second
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := f.Get("hosts/" + host)
+		if err == nil {
+			lastReport, _ := data["last_report"].(string)
+			reportTime, err := parseForemanTime(lastReport)
+			if err == nil && !reportTime.Before(since.Truncate(time.Second)) {
+				globalStatus, _ := data["global_status"].(float64)
+				globalLabel, _ := data["global_status_label"].(string)
+				configurationLabel, _ := data["configuration_status_label"].(string)
+				statusLabel := "global: " + globalLabel + ", configuration: " + configurationLabel
+				log.Debugf("Foreman report received at " + lastReport + ", status " + statusLabel)
+				if globalStatus >= 2 || configurationLabel == "Error" {
+					return statusLabel, errors.New("foreman host status " + statusLabel)
+				}
+				return statusLabel, nil
+			}
+			log.Debugf("Waiting for fresh foreman report, last report: " + lastReport)
+		} else {
+			log.Debugf("Failed to get foreman host status: " + err.Error())
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return "", errors.New("no foreman report received within " + timeout.String())
+		}
+		time.Sleep(interval)
+	}
+}
+
+func parseForemanTime(value string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02 15:04:05 MST", value)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, value)
+	}
+	return t, err
+}
+
+func foremanDetectPuppetPlugin() bool {
+	switch viper.GetString("foreman.config.api") {
+	case "legacy":
+		log.Debugf("Foreman API forced to legacy puppet payload")
+		return false
+	case "puppet_plugin":
+		log.Debugf("Foreman API forced to foreman_puppet plugin payload")
+		return true
+	}
+	status, err := f.Get("status")
+	if err != nil {
+		log.Debugf("Failed to get foreman status, assuming legacy puppet payload !")
+		return false
+	}
+	version, _ := status["version"].(string)
+	log.Debugf("Foreman version: " + version)
+	major, err := strconv.Atoi(strings.Split(version, ".")[0])
+	if err == nil && major >= 3 {
+		return true
+	}
+	// Foreman 2.x may run foreman_puppet plugin as well
+	plugins, err := f.Get("plugins")
+	if err != nil {
+		return false
+	}
+	results, _ := plugins["results"].([]interface{})
+	for _, v := range results {
+		plugin, ok := v.(map[string]interface{})
+		if ok && plugin["name"] == "foreman_puppet" {
+			log.Debugf("Foreman foreman_puppet plugin detected")
+			return true
+		}
+	}
+	return false
+}
+
+func foremanPuppet() *foremanClient {
+	if !foremanPuppetPlugin {
+		return f
+	}
+	fp := *f
+	fp.BaseURL = "https://" + f.Hostname + "/foreman_puppet/api/"
+	return &fp
+}
+
+type foremanInterface struct {
+	Identifier string `json:"identifier"`
+	Ip         string `json:"ip,omitempty"`
+	Ip6        string `json:"ip6,omitempty"`
+	Mac        string `json:"mac,omitempty"`
+	SubnetId   string `json:"subnet_id,omitempty"`
+	Subnet6Id  string `json:"subnet6_id,omitempty"`
+	Primary    bool   `json:"primary"`
+	Provision  bool   `json:"provision"`
+	Managed    bool   `json:"managed"`
+	Type       string `json:"type"`
+}
+
+func foremanInterfaces(primarySubnetId string, primarySubnet6Id string) (interfaces []foremanInterface) {
+	var excludes []*regexp.Regexp
+	for _, pattern := range viper.GetStringSlice("foreman.host.interface.exclude") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Errorf("Invalid interface exclude pattern: " + pattern + " !")
+			continue
+		}
+		excludes = append(excludes, re)
+	}
+	provisionName := viper.GetString("foreman.host.interface.provision")
+	facterInterfaces, ok := viper.Get("puppetfacter.networking.interfaces").(map[string]interface{})
+	if !ok {
+		log.Debugf("Interfaces not found in facter !")
+		return nil
+	}
+	names := make([]string, 0, len(facterInterfaces))
+	for name := range facterInterfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var hasPrimary bool
+	for _, name := range names {
+		excluded := false
+		for _, re := range excludes {
+			if re.MatchString(name) {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			log.Debugf("Interface excluded: " + name)
+			continue
+		}
+		facts, ok := facterInterfaces[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		iface := foremanInterface{
+			Identifier: name,
+			Managed:    true,
+			Type:       "interface",
+		}
+		iface.Ip, _ = facts["ip"].(string)
+		iface.Ip6, _ = facts["ip6"].(string)
+		if !globalIp6(iface.Ip6) {
+			iface.Ip6 = ""
+		}
+		iface.Mac, _ = facts["mac"].(string)
+		if iface.Ip == "" && iface.Ip6 == "" && iface.Mac == "" {
+			log.Debugf("Interface has no addresses, skipping: " + name)
+			continue
+		}
+		if iface.Ip != "" && iface.Ip == ipAddress && !hasPrimary {
+			iface.Primary = true
+			hasPrimary = true
+			iface.SubnetId = primarySubnetId
+			// primary interface carries the host IPv6 address and subnet
+			iface.Ip6 = ip6Address
+			iface.Subnet6Id = primarySubnet6Id
+		} else {
+			if iface.Ip != "" {
+				iface.SubnetId, _ = foremanSubnetId(iface.Ip)
+			}
+			if iface.Ip6 != "" {
+				iface.Subnet6Id, _ = foremanSubnetId(iface.Ip6)
+			}
+		}
+		if provisionName != "" {
+			iface.Provision = name == provisionName
+		} else {
+			iface.Provision = iface.Primary
+		}
+		log.Debugf("Interface found, name: " + name + "; ip: " + iface.Ip + "; ip6: " + iface.Ip6 + "; mac: " + iface.Mac)
+		interfaces = append(interfaces, iface)
+	}
+	if !hasPrimary && len(interfaces) > 0 {
+		log.Warningf("Primary interface not found for IP Address: " + ipAddress + ", using first interface " + interfaces[0].Identifier + " as primary !")
+		interfaces[0].Primary = true
+		if provisionName == "" {
+			interfaces[0].Provision = true
+		}
+	}
+	return interfaces
+}
+
+func foremanHostAttributes() (attributes map[string]interface{}, err error) {
+	attributes = make(map[string]interface{})
+	metaattributes, err := metaGetMerge("foreman.host.attribute")
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range metaattributes {
+		if resource, ok := foremanReferenceAttributes[name]; ok {
+			reference, err := f.SearchResource(resource, value)
+			if err != nil {
+				return nil, errors.New("Host attribute " + name + " " + value + " not found in " + resource)
+			}
+			attributes[name+"_id"] = strconv.FormatFloat(reference["id"].(float64), 'f', -1, 64)
+			log.Debugf("Host attribute " + name + " resolved, name: " + value + "; id: " + attributes[name+"_id"].(string))
+			continue
+		}
+		switch name {
+		case "owner":
+			// owner is a user login or a usergroup name
+			var owner map[string]interface{}
+			ownerType := "User"
+			users, err := f.search("users", "login="+value)
+			if err == nil {
+				if matches := filterResource(users, "login", value); len(matches) == 1 {
+					owner = matches[0]
+				}
+			}
+			if owner == nil {
+				owner, err = f.SearchResource("usergroups", value)
+				ownerType = "Usergroup"
+			}
+			if err != nil {
+				return nil, errors.New("Host owner " + value + " not found in users or usergroups")
+			}
+			attributes["owner_id"] = strconv.FormatFloat(owner["id"].(float64), 'f', -1, 64)
+			attributes["owner_type"] = ownerType
+			log.Debugf("Host owner resolved, name: " + value + "; type: " + ownerType)
+		case "managed", "enabled", "build":
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("Host attribute " + name + " is not a boolean: " + value)
+			}
+			attributes[name] = flag
+		default:
+			parsed, err := metaTemplate(value)
+			if err != nil {
+				return nil, errors.New("Failed to parse host attribute " + name + " value " + value)
+			}
+			attributes[name] = parsed
+		}
+		log.Debugf("Host attribute set: " + name)
+	}
+	return attributes, nil
+}
+
+// mergeHostAttributes overlays attributes onto the host of a host payload,
+// puppet attributes onto its puppet_attributes with the foreman_puppet plugin.
+func mergeHostAttributes(jsonText []byte, attributes map[string]interface{}) ([]byte, error) {
+	var hostMap map[string]map[string]interface{}
+	err := json.Unmarshal(jsonText, &hostMap)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range attributes {
+		if foremanPuppetPlugin && foremanPuppetAttributes[k] {
+			puppetAttributes, ok := hostMap["host"]["puppet_attributes"].(map[string]interface{})
+			if !ok {
+				puppetAttributes = make(map[string]interface{})
+				hostMap["host"]["puppet_attributes"] = puppetAttributes
+			}
+			puppetAttributes[k] = v
+			continue
+		}
+		hostMap["host"][k] = v
+	}
+	return json.Marshal(hostMap)
+}
+
 func foremanUpdateParameters(host string, parameters map[string]string) (err error) {
 	type HostResource struct {
 		Parameters []map[string]string `json:"host_parameters_attributes"`
@@ -1184,6 +2039,9 @@ func foremanUpdateParameters(host string, parameters map[string]string) (err err
 		hostParameters := make([]map[string]string, 0)
 		for _, v := range hostGet["parameters"].([]interface{}) {
 			subparams := v.(map[string]interface{})
+			if _, ok := parameters[subparams["name"].(string)]; ok {
+				continue
+			}
 			newparam := make(map[string]string)
 			newparam["name"] = subparams["name"].(string)
 			newparam["value"] = subparams["value"].(string)
@@ -1202,6 +2060,13 @@ func foremanUpdateParameters(host string, parameters map[string]string) (err err
 			Parameters: hostParameters,
 		}
 		jsonText, err := json.Marshal(hostMap)
+		if len(hostAttributes) > 0 {
+			jsonText, err = mergeHostAttributes(jsonText, hostAttributes)
+			if err != nil {
+				log.Errorf("Failed to merge host attributes !")
+				return err
+			}
+		}
 		data, err := f.Put("hosts/"+host, jsonText)
 		if err != nil {
 			log.Errorf("Failed to update host parameters in foreman !")
@@ -1215,7 +2080,7 @@ func foremanUpdateParameters(host string, parameters map[string]string) (err err
 	//	if err != nil {
 	//		log.Errorf("Error deleting host, retrying in 5s !")
 	//		time.Sleep(5 * time.Second)
-	return nil
+	return err
 }
 
 func killPuppet() {
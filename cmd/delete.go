@@ -21,10 +21,10 @@
 package cmd
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 
-	"github.com/cloudevelops/go-foreman"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -42,13 +42,47 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Debugf("Delete command: starting")
 		//Foreman prototype
-		f := foreman.NewForeman(viper.GetString("foreman.config.host"), viper.GetString("foreman.config.username"), viper.GetString("foreman.config.password"))
+		f, err := newForeman()
+		if err != nil {
+			log.Errorf("Foreman client failed: " + err.Error())
+			return
+		}
 		// Host
 		hostFqdn = viper.GetString("openstackmeta.name")
 		hostNameSplit := strings.Split(hostFqdn, ".")
 		hostName = hostNameSplit[0]
 		domainName = strings.Replace(hostFqdn, hostName+".", "", -1)
-		host, err := f.SearchResource("hosts", hostFqdn)
+		// DNS records created by create
+		if !dnsConfigured() {
+			log.Debugf("DNS host not configured, skipping")
+		} else if err = newDnsBackends(); err != nil {
+			log.Errorf("DNS provider failed, skipping DNS record deletion: " + err.Error() + " !")
+		} else {
+			log.Debugf("Starting DNS record deletion on backends: " + strings.Join(dnsBackendNames(), ", "))
+			hostIpAddresses(viper.GetInt("puppet.version"))
+			dnsBegin()
+			dnsDeleteHostRecords()
+			err = dnsCommit()
+			if err != nil {
+				log.Errorf("Failed to apply DNS changes: " + err.Error() + " !")
+			}
+		}
+		if onlyDNS {
+			log.Debugf("Only DNS was to be managed this run, exiting.")
+			return
+		}
+		var host map[string]interface{}
+		err = errors.New("Host not found")
+		instanceUuid := viper.GetString("openstackmeta.uuid")
+		if viper.GetString("foreman.host.compute_resource") != "" && instanceUuid != "" {
+			host, err = f.SearchHostUuid(instanceUuid)
+			if err != nil {
+				log.Debugf("Host not found for instance uuid: " + instanceUuid + ", matching by name")
+			}
+		}
+		if err != nil {
+			host, err = f.SearchResource("hosts", hostFqdn)
+		}
 		if err == nil {
 			log.Debugf("Host exists, deleting")
 			hostId := strconv.FormatFloat(host["id"].(float64), 'f', -1, 64)
@@ -63,6 +97,148 @@ to quickly create a Cobra application.`,
 	},
 }
 
+// dnsDeleteHostRecords removes the host records create sets up, from the
+// backends create writes them to.
+func dnsDeleteHostRecords() {
+	dnsForTargets("host", nil, func() {
+		dnsDeleteOwned(domainName, "A", hostFqdn+".")
+		dnsDeleteOwned(domainName, "AAAA", hostFqdn+".")
+	})
+	dnsForTargets("ptr", nil, func() {
+		for _, address := range []string{ipAddress, ip6Address} {
+			if address != "" {
+				dnsDeletePtr(address)
+			}
+		}
+	})
+	doMetaSliceMap("dns.record.mya", dnsTargeted("mya", dnsDeleteMyA))
+	doMetaSlice("dns.record.mycname", dnsTargetedSlice("mycname", dnsDeleteMyCname))
+	doMetaSlice("dns.record.mypubcname", dnsTargetedSlice("mypubcname", dnsDeleteMyPubCname))
+	// shared records keep all but the host member values
+	doMetaSliceMap("dns.record.a", dnsTargeted("a", dnsDeleteMemberA))
+	doMetaSliceMap("dns.record.roota", dnsTargeted("roota", dnsDeleteMemberRootA))
+	doMetaSliceMap("dns.record.txt", dnsTargeted("txt", dnsDeleteMemberTxt))
+	doMetaSliceMap("dns.record.srv", dnsTargeted("srv", dnsDeleteMemberSrv))
+	doMetaSliceMap("dns.record.mx", dnsTargeted("mx", dnsDeleteMemberMx))
+	doMetaSliceMap("dns.record.caa", dnsTargeted("caa", dnsDeleteMemberCaa))
+}
+
+func dnsDeletePtr(address string) {
+	ptrRecord, ptrDomain, err := reverseRecord(address)
+	if err != nil {
+		log.Debugf("Failed to build PTR record for " + address + ": " + err.Error() + " !")
+		return
+	}
+	if classRecord, classDomain, ok := reverseClassless(address); ok {
+		if viper.GetBool("dns.config.reverse.classless_cname") {
+			dnsDeleteOwned(ptrDomain, "CNAME", ptrRecord)
+		}
+		ptrRecord, ptrDomain = classRecord, classDomain
+	}
+	dnsDeleteOwned(ptrDomain, "PTR", ptrRecord)
+}
+
+func dnsDeleteMyA(hash map[string]interface{}) {
+	for _, entry := range dnsRecordEntries("dns.record.mya", "A", hash) {
+		zone, err := dnsRecordZone(entry.name+"."+domainName, entry.zone)
+		if err != nil {
+			log.Debugf("Invalid dns.record.mya record " + entry.name + ": " + err.Error() + " !")
+			continue
+		}
+		if entry.member {
+			dnsDeleteOwnMember(zone, "A", entry.name+"."+domainName+".", entry.value)
+		} else {
+			dnsDeleteOwned(zone, "A", entry.name+"."+domainName+".")
+		}
+	}
+}
+
+func dnsDeleteMemberA(hash map[string]interface{}) {
+	for _, entry := range dnsRecordEntries("dns.record.a", "A", hash) {
+		if !entry.member {
+			continue
+		}
+		zone, err := dnsRecordZone(entry.name, entry.zone)
+		if err != nil {
+			log.Debugf("Invalid dns.record.a record " + entry.name + ": " + err.Error() + " !")
+			continue
+		}
+		dnsDeleteOwnMember(zone, "A", entry.name+".", entry.value)
+	}
+}
+
+func dnsDeleteMemberRootA(hash map[string]interface{}) {
+	for _, entry := range dnsRecordEntries("dns.record.roota", "A", hash) {
+		if entry.member {
+			dnsDeleteOwnMember(entry.name, "A", entry.name+".", entry.value)
+		}
+	}
+}
+
+func dnsDeleteMemberTxt(hash map[string]interface{}) {
+	dnsDeleteMemberStructured("dns.record.txt", "TXT", hash)
+}
+
+func dnsDeleteMemberSrv(hash map[string]interface{}) {
+	dnsDeleteMemberStructured("dns.record.srv", "SRV", hash)
+}
+
+func dnsDeleteMemberMx(hash map[string]interface{}) {
+	dnsDeleteMemberStructured("dns.record.mx", "MX", hash)
+}
+
+func dnsDeleteMemberCaa(hash map[string]interface{}) {
+	dnsDeleteMemberStructured("dns.record.caa", "CAA", hash)
+}
+
+func dnsDeleteMemberStructured(config string, dtype string, hash map[string]interface{}) {
+	entry, ok := dnsStructuredEntry(config, dtype, hash)
+	if ok && entry.member {
+		dnsDeleteOwnMember(entry.zone, dtype, entry.name, entry.value)
+	}
+}
+
+// dnsDeleteOwnMember removes the host value from a member rrset.
+func dnsDeleteOwnMember(zone string, dtype string, name string, content string) {
+	log.Debugf(noopMsg + "Deleting " + dtype + " record member, domain: " + zone + ", name: " + name + ", value: " + content + " !")
+	if !noop {
+		err := dnsDeleteMember(zone, dtype, name, content)
+		if err != nil {
+			log.Debugf("Failed to delete " + dtype + " record member, domain: " + zone + ", name: " + name + ", value: " + content + " !")
+			return
+		}
+		log.Debugf("Deleted " + dtype + " record member, domain: " + zone + ", name: " + name + ", value: " + content + " !")
+	}
+}
+
+func dnsDeleteMyCname(s string) {
+	pS, err := metaTemplate(s)
+	if err != nil {
+		log.Debugf("Failed to parse dns.record.mycname value " + s + " !")
+		return
+	}
+	zone, err := dnsRecordZone(pS+"."+domainName, "")
+	if err != nil {
+		log.Debugf("Invalid dns.record.mycname record " + pS + ": " + err.Error() + " !")
+		return
+	}
+	dnsDeleteOwned(zone, "CNAME", pS+"."+domainName+".")
+}
+
+func dnsDeleteMyPubCname(s string) {
+	pS, err := metaTemplate(s)
+	if err != nil {
+		log.Debugf("Failed to parse dns.record.mypubcname value " + s + " !")
+		return
+	}
+	pSDomainName, err := dnsRecordZone(pS, "")
+	if err != nil {
+		log.Debugf("Invalid dns.record.mypubcname record " + pS + ": " + err.Error() + " !")
+		return
+	}
+	dnsDeleteOwned(pSDomainName, "CNAME", pS+".")
+}
+
 func init() {
 	RootCmd.AddCommand(deleteCmd)
 
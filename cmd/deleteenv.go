@@ -21,9 +21,8 @@
 package cmd
 
 import (
-	"github.com/cloudevelops/go-foreman"
-	"github.com/cloudevelops/go-powerdns"
 	//	"github.com/davecgh/go-spew/spew"
+	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"strconv"
@@ -31,9 +30,13 @@ import (
 	"time"
 )
 
-var fo *foreman.Foreman
+var fo *foremanClient
 var whitelistarr []string
 
+// deletedAddresses maps addresses of deleted hosts and A records to the
+// deleted names, so their PTR records can be removed.
+var deletedAddresses = make(map[string]map[string]bool)
+
 // deleteenvCmd represents the deleteenv command
 var deleteenvCmd = &cobra.Command{
 	Use:   "deleteenv",
@@ -55,23 +58,56 @@ var deleteenvCmd = &cobra.Command{
 		}
 		log.Debugf("Starting deleteenv")
 		//Foreman prototype
-		fo = foreman.NewForeman(viper.GetString("foreman.config.host"), viper.GetString("foreman.config.username"), viper.GetString("foreman.config.password"))
+		var err error
+		fo, err = newForeman()
+		if err != nil {
+			log.Errorf("Foreman client failed: " + err.Error())
+			return
+		}
 		//Init DNS
-		dnsHost := viper.GetString("dns.config.host")
-		if dnsHost == "" {
+		dnsEnabled := dnsConfigured()
+		if !dnsEnabled {
 			log.Debugf("DNS host not configured, skipping")
 		} else {
-			log.Debugf("Inicializing powerdns")
-			dnsKey := viper.GetString("dns.config.key")
-			if dnsKey == "" {
-				log.Debugf("DNS key not found !")
-				dnsHost = ""
-			} else {
-				// Inicialize powerdns
-				dnsNameservers := viper.GetStringSlice("dns.config.nameservers")
-				p = powerdns.NewPowerdns(dnsHost, dnsKey, dnsNameservers)
+			log.Debugf("Inicializing DNS provider")
+			err = newDnsBackends()
+			if err != nil {
+				log.Debugf("DNS provider failed: " + err.Error() + " !")
+				dnsEnabled = false
 			}
 		}
+		// Hosts matched by openstack instance uuid
+		if matchUuid {
+			var deletedHosts []string
+			for _, uuid := range args {
+				host, err := fo.SearchHostUuid(uuid)
+				if err != nil {
+					log.Debugf("Host not found for instance uuid: " + uuid)
+					continue
+				}
+				hostName = host["name"].(string)
+				hostId := strconv.FormatFloat(host["id"].(float64), 'f', -1, 64)
+				if checkWhitelist(hostName) {
+					log.Debugf("Whitelisted, NOT deleting host: " + hostName + " !")
+					continue
+				}
+				log.Debugf(noopMsg + "Deleting host: " + hostName + ", instance uuid: " + uuid)
+				if !noop {
+					err := foremanDelId(hostId)
+					if err != nil {
+						log.Debugf("Foreman failed to delete host: " + hostName + " !")
+						continue
+					}
+				}
+				addForemanDeletedAddresses(host)
+				deletedHosts = append(deletedHosts, hostName)
+			}
+			if dnsEnabled {
+				dnsDeleteHostsRecords(deletedHosts)
+				dnsDeleteEnvPtrs()
+			}
+			return
+		}
 		// Host
 		for _, env := range args {
 			//hostNameSplit := strings.Split(hostFqdn, ".")
@@ -102,93 +138,27 @@ var deleteenvCmd = &cobra.Command{
 							err := foremanDel(hostName)
 							if err != nil {
 								log.Debugf("Foreman failed to delete host: " + hostName + " !")
+								continue
 							}
 						}
+						addForemanDeletedAddresses(resultData)
 					} else {
 						log.Debugf("Whitelisted, NOT deleting host: " + hostName + " !")
 					}
 				}
 			}
-			if dnsHost == "" {
+			if !dnsEnabled {
 				log.Debugf("DNS host not configured, skipping")
 			} else {
-				log.Debugf("Starting DNS record management for host: " + dnsHost)
-				querydomain := env
-				if !deleteDomains {
-					log.Debugf("Domains not managed, clearing for host: " + dnsHost)
-					domain, err := p.Get("zones/" + querydomain)
-					if err == nil {
-						domainMap := domain.(map[string]interface{})
-						rrsets := domainMap["rrsets"].([]interface{})
-						for _, rrset := range rrsets {
-							rrdata := rrset.(map[string]interface{})
-							rrtype := rrdata["type"].(string)
-							rrname := rrdata["name"].(string)
-							whiterrname := rrname[:len(rrname)-1]
-							if rrtype == "A" {
-								whitelistCheck := checkWhitelist(whiterrname)
-								if !whitelistCheck {
-									log.Debugf(noopMsg + "Deleting " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-									if !noop {
-										err := p.DeleteRec(querydomain, rrtype, rrname)
-										if err != nil {
-											log.Debugf("Failed to delete " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
-										}
-										log.Debugf("Deleted " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-									}
-								} else {
-									log.Debugf("Whitelisted, NOT deleting " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-								}
-							}
-							if rrtype == "CNAME" {
-								whitelistCheck := checkWhitelist(whiterrname)
-								if !whitelistCheck {
-									log.Debugf(noopMsg + "Deleting " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-									if !noop {
-										err := p.DeleteRec(querydomain, rrtype, rrname)
-										if err != nil {
-											log.Debugf("Failed to delete " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
-										}
-										log.Debugf("Deleted " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-									}
-								} else {
-									log.Debugf("Whitelisted, NOT deleting " + rrtype + " record, domain: " + domainName + ", name: " + rrname + " !")
-								}
-							}
-						}
-					}
-				} else {
-					log.Debugf("Domains managed, clearing all domains for match: " + env)
-					domains, err := p.Get("zones")
-					if err == nil {
-						domainsMap := domains.([]interface{})
-						for _, domainField := range domainsMap {
-							domainData := domainField.(map[string]interface{})
-							domainId := domainData["id"].(string)
-							domainName := domainId[:len(domainId)-1]
-							if strings.Contains(domainName, env) {
-								log.Debugf("Domain " + domainName + " matches environment " + env)
-								whitelistCheck := checkWhitelist(domainName)
-								if !whitelistCheck {
-									log.Debugf(noopMsg + "Deleting domain: " + domainName)
-									if !noop {
-										err := p.DeleteDomain(domainId)
-										if err != nil {
-											log.Debugf("Failed to delete domain: " + domainName + " !")
-										}
-										log.Debugf("Deleted domain: " + domainName + " !")
-									}
-								} else {
-									log.Debugf("Whitelisted, NOT deleting domain: " + domainName + " !")
-								}
-							}
-						}
-					} else {
-						log.Errorf("Powerdns query failed, skipping !")
-					}
+				for _, backend := range dnsBackendNames() {
+					dnsUse(backend)
+					dnsDeleteEnvRecords(env)
 				}
 			}
 		}
+		if dnsEnabled {
+			dnsDeleteEnvPtrs()
+		}
 	},
 }
 
@@ -211,34 +181,298 @@ func foremanDel(hostFqdn string) error {
 	if err == nil {
 		log.Debugf("Host exists, deleting")
 		hostId := strconv.FormatFloat(host["id"].(float64), 'f', -1, 64)
+		return foremanDelId(hostId)
+	}
+	return err
+}
+
+func foremanDelId(hostId string) error {
+	err := fo.DeleteHost(hostId)
+	if err != nil {
+		log.Errorf("Error deleting host, retrying in 5s !")
+		time.Sleep(5 * time.Second)
 		err := fo.DeleteHost(hostId)
 		if err != nil {
-			log.Errorf("Error deleting host, retrying in 5s !")
-			time.Sleep(5 * time.Second)
+			log.Errorf("Error deleting host, retrying in 15s !")
+			time.Sleep(15 * time.Second)
 			err := fo.DeleteHost(hostId)
 			if err != nil {
-				log.Errorf("Error deleting host, retrying in 15s !")
-				time.Sleep(15 * time.Second)
-				err := fo.DeleteHost(hostId)
-				if err != nil {
-					log.Errorf("Error deleting host, retrying in 60s !")
-					for i := 1; i < 31; i++ {
-						time.Sleep(60 * time.Second)
-						err := fo.DeleteHost(hostId)
+				log.Errorf("Error deleting host, retrying in 60s !")
+				for i := 1; i < 31; i++ {
+					time.Sleep(60 * time.Second)
+					err := fo.DeleteHost(hostId)
+					if err != nil {
+						log.Errorf("Error deleting host, retrying in 60s !")
+					} else {
+						return err
+					}
+				}
+				log.Errorf("Error deleting host, giving up !")
+				return err
+			}
+		}
+		return err
+	}
+	return err
+}
+
+// dnsDeleteHostsRecords removes the A and AAAA records of deleted hosts from
+// every backend, when owned by the host.
+func dnsDeleteHostsRecords(hosts []string) {
+	var removed []dnsRecord
+	dnsBegin()
+	for _, backend := range dnsBackendNames() {
+		dnsUse(backend)
+		for _, host := range hosts {
+			name := dns.Fqdn(host)
+			zone, err := dnsRecordZone(name, "")
+			if err != nil {
+				log.Debugf("Failed to find zone of host " + host + ": " + err.Error() + " !")
+				continue
+			}
+			records, err := dnsZoneRecords(zone)
+			if err != nil {
+				log.Debugf("Failed to list zone " + zone + ", NOT deleting records of host " + host + " !")
+				continue
+			}
+			owners := dnsOwners(records)
+			for _, rrtype := range []string{"A", "AAAA"} {
+				var rrset []dnsRecord
+				for _, record := range records {
+					if record.Type == rrtype && record.Name == name {
+						rrset = append(rrset, record)
+					}
+				}
+				if len(rrset) == 0 {
+					continue
+				}
+				if !dnsOwned(owners, rrtype, name, host) {
+					log.Debugf("Not owned by " + host + ", NOT deleting " + rrtype + " record, domain: " + zone + ", name: " + name + " !")
+					continue
+				}
+				log.Debugf(noopMsg + "Deleting " + rrtype + " record, domain: " + zone + ", name: " + name + " !")
+				if !noop {
+					err := dnsDelete(zone, rrtype, name)
+					if err != nil {
+						log.Debugf("Failed to delete " + rrtype + " record, domain: " + zone + ", name: " + name + " !")
+						continue
+					}
+				}
+				removed = append(removed, rrset...)
+			}
+		}
+	}
+	err := dnsCommit()
+	if err != nil {
+		log.Errorf("Failed to apply DNS changes of host records: " + err.Error() + " !")
+		return
+	}
+	for _, record := range removed {
+		addDeletedAddress(record.Content, record.Name)
+	}
+}
+
+func addDeletedAddress(address string, name string) {
+	if address == "" {
+		return
+	}
+	if deletedAddresses[address] == nil {
+		deletedAddresses[address] = make(map[string]bool)
+	}
+	deletedAddresses[address][dns.Fqdn(name)] = true
+}
+
+func addForemanDeletedAddresses(host map[string]interface{}) {
+	name, _ := host["name"].(string)
+	for _, field := range []string{"ip", "ip6"} {
+		address, _ := host[field].(string)
+		addDeletedAddress(address, name)
+	}
+}
+
+// dnsDeleteEnvRecords removes the records of env from the current backend.
+func dnsDeleteEnvRecords(env string) {
+	log.Debugf("Starting DNS record management on backend: " + dnsBackend)
+	querydomain := env
+	if !deleteDomains {
+		log.Debugf("Domains not managed, clearing for backend: " + dnsBackend)
+		records, err := p.Records(querydomain)
+		if err == nil {
+			owners := dnsOwners(records)
+			// addresses of A and AAAA rrsets, for PTR cleanup
+			addresses := make(map[string][]string)
+			for _, record := range records {
+				if record.Type == "A" || record.Type == "AAAA" {
+					addresses[record.Type+" "+record.Name] = append(addresses[record.Type+" "+record.Name], record.Content)
+				}
+			}
+			deleted := make(map[string]bool)
+			var removed []dnsRecord
+			dnsBegin()
+			for _, record := range records {
+				rrtype := record.Type
+				rrname := record.Name
+				// rrsets with several records are deleted once
+				if deleted[rrtype+" "+rrname] {
+					continue
+				}
+				deleted[rrtype+" "+rrname] = true
+				// with ownership tracking any rrset stackconf wrote is deleted
+				if dnsOwnership() == "" && rrtype != "A" && rrtype != "CNAME" {
+					continue
+				}
+				if dnsOwnership() != "" && rrtype == "TXT" && strings.HasPrefix(rrname, dnsOwnerPrefix) {
+					continue
+				}
+				if !dnsOwned(owners, rrtype, rrname, "") {
+					if rrtype == "A" || rrtype == "CNAME" {
+						log.Debugf("Not owned by stackconf, NOT deleting " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
+					}
+					continue
+				}
+				whiterrname := rrname[:len(rrname)-1]
+				whitelistCheck := checkWhitelist(whiterrname)
+				if !whitelistCheck {
+					log.Debugf(noopMsg + "Deleting " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
+					if !noop {
+						err := dnsDelete(querydomain, rrtype, rrname)
 						if err != nil {
-							log.Errorf("Error deleting host, retrying in 60s !")
-						} else {
-							return err
+							log.Debugf("Failed to delete " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
+							continue
 						}
+						log.Debugf("Deleted " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
+					}
+					removed = append(removed, record)
+				} else {
+					log.Debugf("Whitelisted, NOT deleting " + rrtype + " record, domain: " + querydomain + ", name: " + rrname + " !")
+				}
+			}
+			err = dnsCommit()
+			if err != nil {
+				log.Errorf("Failed to apply DNS changes, domain: " + querydomain + ": " + err.Error() + " !")
+			} else {
+				for _, record := range removed {
+					for _, address := range addresses[record.Type+" "+record.Name] {
+						addDeletedAddress(address, record.Name)
+					}
+				}
+			}
+		}
+	} else {
+		log.Debugf("Domains managed, clearing all domains for match: " + env)
+		domains, err := p.Zones()
+		if err == nil {
+			for _, domainName := range domains {
+				if strings.Contains(domainName, env) {
+					log.Debugf("Domain " + domainName + " matches environment " + env)
+					whitelistCheck := checkWhitelist(domainName)
+					if !whitelistCheck {
+						log.Debugf(noopMsg + "Deleting domain: " + domainName)
+						// A and AAAA records of the zone, for PTR cleanup
+						records, _ := p.Records(domainName)
+						if !noop {
+							err := p.DeleteZone(domainName)
+							if err != nil {
+								log.Debugf("Failed to delete domain: " + domainName + " !")
+								continue
+							}
+							log.Debugf("Deleted domain: " + domainName + " !")
+						}
+						for _, record := range records {
+							if record.Type == "A" || record.Type == "AAAA" {
+								addDeletedAddress(record.Content, record.Name)
+							}
+						}
+					} else {
+						log.Debugf("Whitelisted, NOT deleting domain: " + domainName + " !")
 					}
-					log.Errorf("Error deleting host, giving up !")
-					return err
 				}
 			}
-			return err
+		} else {
+			log.Errorf("DNS zones query failed, skipping !")
+		}
+	}
+}
+
+// dnsDeleteEnvPtrs removes PTR records of deleted addresses, when they point
+// only to deleted names.
+func dnsDeleteEnvPtrs() {
+	dnsBegin()
+	for _, backend := range dnsBackendNames() {
+		dnsUse(backend)
+		dnsDeleteBackendPtrs()
+	}
+	err := dnsCommit()
+	if err != nil {
+		log.Errorf("Failed to apply DNS changes of PTR records: " + err.Error() + " !")
+	}
+}
+
+// dnsDeleteBackendPtrs queues the PTR deletions of the current backend.
+func dnsDeleteBackendPtrs() {
+	for address, names := range deletedAddresses {
+		ptrRecord, ptrDomain, err := reverseRecord(address)
+		if err != nil {
+			log.Debugf("Failed to build PTR record for " + address + ": " + err.Error() + " !")
+			continue
+		}
+		cnameRecord, cnameDomain := "", ""
+		if classRecord, classDomain, ok := reverseClassless(address); ok {
+			if viper.GetBool("dns.config.reverse.classless_cname") {
+				cnameRecord, cnameDomain = ptrRecord, ptrDomain
+			}
+			ptrRecord, ptrDomain = classRecord, classDomain
+		}
+		records, err := dnsZoneRecords(ptrDomain)
+		if err != nil {
+			log.Debugf("Failed to list reverse zone " + ptrDomain + ", NOT deleting PTR record " + ptrRecord + " !")
+			continue
+		}
+		var found, foreign bool
+		for _, record := range records {
+			if record.Type != "PTR" || record.Name != ptrRecord {
+				continue
+			}
+			found = true
+			if !names[dns.Fqdn(record.Content)] {
+				foreign = true
+			}
+		}
+		if !found {
+			log.Debugf("PTR record not found, domain: " + ptrDomain + ", name: " + ptrRecord)
+			continue
+		}
+		if foreign {
+			log.Debugf("PTR record points to a name not deleted, NOT deleting PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+			continue
+		}
+		if checkWhitelist(strings.TrimSuffix(ptrRecord, ".")) {
+			log.Debugf("Whitelisted, NOT deleting PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+			continue
+		}
+		if !dnsOwned(dnsOwners(records), "PTR", ptrRecord, "") {
+			log.Debugf("Not owned by stackconf, NOT deleting PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+			continue
+		}
+		log.Debugf(noopMsg + "Deleting PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+		if !noop {
+			err := dnsDelete(ptrDomain, "PTR", ptrRecord)
+			if err != nil {
+				log.Debugf("Failed to delete PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+				continue
+			}
+			log.Debugf("Deleted PTR record, domain: " + ptrDomain + ", name: " + ptrRecord + " !")
+		}
+		if cnameRecord != "" {
+			log.Debugf(noopMsg + "Deleting CNAME record, domain: " + cnameDomain + ", name: " + cnameRecord + " !")
+			if !noop {
+				err := dnsDelete(cnameDomain, "CNAME", cnameRecord)
+				if err != nil {
+					log.Debugf("Failed to delete CNAME record, domain: " + cnameDomain + ", name: " + cnameRecord + " !")
+				}
+			}
 		}
 	}
-	return err
 }
 
 func checkWhitelist(host string) bool {
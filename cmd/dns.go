@@ -0,0 +1,708 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudevelops/go-powerdns"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// dnsProvider manages DNS records. Zones are given without the trailing dot,
+// record names are fully qualified with the trailing dot. The zone is a hint,
+// providers store the record in the closest existing zone.
+type dnsProvider interface {
+	// Apply applies rrset changes, in one atomic request per zone.
+	Apply(changes []dnsChange) error
+	// Records lists all records of a zone.
+	Records(zone string) ([]dnsRecord, error)
+	// Zones lists all zones of the provider.
+	Zones() ([]string, error)
+	// DeleteZone removes a zone with all its records.
+	DeleteZone(zone string) error
+	// CreateZone creates a zone with the given settings.
+	CreateZone(zone string, settings dnsZoneSettings) error
+}
+
+// dnsChange replaces the name/type rrset with content, or removes it when
+// Delete is set. Comment, when set, replaces the rrset comments. Member
+// changes add content to the rrset, or remove it with Delete, keeping the
+// other records of the rrset.
+type dnsChange struct {
+	Zone    string
+	Type    string
+	Name    string
+	Content string
+	Ttl     int
+	Comment string
+	Delete  bool
+	Member  bool
+}
+
+// dnsZoneSettings describe zones created by stackconf.
+type dnsZoneSettings struct {
+	Kind        string
+	Nameservers []string
+	SoaEditApi  string
+	Metadata    map[string][]string
+}
+
+type dnsRecord struct {
+	Name    string
+	Type    string
+	Content string
+	Ttl     int
+	Comment string
+}
+
+var p dnsProvider
+
+// newDnsProvider builds the provider selected by the provider setting under
+// prefix, dns.config or dns.backends.<name>.
+func newDnsProvider(prefix string) (dnsProvider, error) {
+	dnsHost := viper.GetString(prefix + ".host")
+	switch provider := viper.GetString(prefix + ".provider"); provider {
+	case "", "powerdns":
+		dnsKey := viper.GetString(prefix + ".key")
+		if dnsKey == "" {
+			return nil, errors.New("DNS key not found")
+		}
+		dnsNameservers := viper.GetStringSlice(prefix + ".nameservers")
+		return &powerdnsProvider{pdns: powerdns.NewPowerdns(dnsHost, dnsKey, dnsNameservers)}, nil
+	case "rfc2136":
+		return newRfc2136Provider(dnsHost, viper.GetString(prefix+".tsig.name"), viper.GetString(prefix+".tsig.secret"), viper.GetString(prefix+".tsig.algorithm"), viper.GetStringSlice(prefix+".zones"))
+	default:
+		return nil, errors.New("Unknown DNS provider: " + provider)
+	}
+}
+
+// dnsDefaultTtl is used when dns.config.ttl sets no TTL for the record type.
+const dnsDefaultTtl = 10
+
+// dnsTtl returns the TTL of dtype records from dns.config.ttl, a map of
+// lowercase record types to TTLs with an optional default entry.
+func dnsTtl(dtype string) int {
+	for _, key := range []string{"dns.config.ttl." + strings.ToLower(dtype), "dns.config.ttl.default"} {
+		if viper.IsSet(key) {
+			if ttl := viper.GetInt(key); ttl > 0 {
+				return ttl
+			}
+			log.Debugf("Invalid TTL in " + key + ", ignoring !")
+		}
+	}
+	return dnsDefaultTtl
+}
+
+// dnsRecordContent builds the content of structured TXT, SRV, MX and CAA
+// records from their templated fields.
+func dnsRecordContent(dtype string, fields map[string]string) (string, error) {
+	switch dtype {
+	case "TXT":
+		return dnsTxtContent(fields["value"]), nil
+	case "SRV":
+		var values []string
+		for _, field := range []string{"priority", "weight", "port"} {
+			value, err := dnsUint16(fields, field)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		if fields["target"] == "" {
+			return "", errors.New("SRV target not set")
+		}
+		return strings.Join(values, " ") + " " + dns.Fqdn(fields["target"]), nil
+	case "MX":
+		priority, err := dnsUint16(fields, "priority")
+		if err != nil {
+			return "", err
+		}
+		if fields["target"] == "" {
+			return "", errors.New("MX target not set")
+		}
+		return priority + " " + dns.Fqdn(fields["target"]), nil
+	case "CAA":
+		if fields["flags"] == "" {
+			fields["flags"] = "0"
+		}
+		flags, err := strconv.ParseUint(fields["flags"], 10, 8)
+		if err != nil {
+			return "", errors.New("Invalid CAA flags " + fields["flags"])
+		}
+		if fields["tag"] == "" {
+			return "", errors.New("CAA tag not set")
+		}
+		return strconv.FormatUint(flags, 10) + " " + fields["tag"] + " " + dnsQuote(fields["value"]), nil
+	default:
+		return "", errors.New("Unsupported record type " + dtype)
+	}
+}
+
+func dnsUint16(fields map[string]string, field string) (string, error) {
+	value, err := strconv.ParseUint(fields[field], 10, 16)
+	if err != nil {
+		return "", errors.New("Invalid " + field + " " + fields[field])
+	}
+	return strconv.FormatUint(value, 10), nil
+}
+
+// dnsTxtContent quotes text, split into 255 byte character strings.
+func dnsTxtContent(text string) string {
+	var chunks []string
+	for len(text) > 255 {
+		chunks = append(chunks, dnsQuote(text[:255]))
+		text = text[255:]
+	}
+	return strings.Join(append(chunks, dnsQuote(text)), " ")
+}
+
+func dnsQuote(text string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(text) + "\""
+}
+
+// dnsMemberContents returns the rrset contents after the member change.
+func dnsMemberContents(change dnsChange, contents []string) []string {
+	var result []string
+	for _, content := range contents {
+		if !dnsSameContent(change.Type, content, change.Content) {
+			result = append(result, content)
+		}
+	}
+	if !change.Delete {
+		result = append(result, change.Content)
+	}
+	return result
+}
+
+// dnsHasMember reports whether the records hold the member change content.
+func dnsHasMember(records []dnsRecord, change dnsChange) bool {
+	for _, record := range records {
+		if record.Type == change.Type && record.Name == change.Name && dnsSameContent(change.Type, record.Content, change.Content) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsSameContent reports whether a and b are the same dtype record data, as
+// providers may return it in canonical form.
+func dnsSameContent(dtype string, a string, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	ra, err := dns.NewRR(". 0 IN " + dtype + " " + a)
+	if err != nil {
+		return false
+	}
+	rb, err := dns.NewRR(". 0 IN " + dtype + " " + b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(dnsRdata(ra), dnsRdata(rb))
+}
+
+var dnsZones = make(map[string][]string)
+
+// dnsZoneList returns the zones of the current backend, listed once per run.
+func dnsZoneList() ([]string, error) {
+	if zones, ok := dnsZones[dnsBackend]; ok {
+		return zones, nil
+	}
+	zones, err := p.Zones()
+	if err != nil {
+		return nil, err
+	}
+	dnsZones[dnsBackend] = append(make([]string, 0, len(zones)), zones...)
+	return dnsZones[dnsBackend], nil
+}
+
+var dnsZoneRecordCache = make(map[string][]dnsRecord)
+
+// dnsZoneRecords returns the zone records of the current backend, listed once
+// per run.
+func dnsZoneRecords(zone string) ([]dnsRecord, error) {
+	key := dnsBackend + " " + zone
+	if records, ok := dnsZoneRecordCache[key]; ok {
+		return records, nil
+	}
+	records, err := p.Records(zone)
+	if err != nil {
+		return nil, err
+	}
+	dnsZoneRecordCache[key] = records
+	return records, nil
+}
+
+// longestZone returns the longest of zones containing name, or "".
+func longestZone(name string, zones []string) string {
+	var zone string
+	for _, candidate := range zones {
+		candidate = strings.TrimSuffix(candidate, ".")
+		if candidate != "" && dns.IsSubDomain(candidate+".", name) && len(candidate) > len(zone) {
+			zone = candidate
+		}
+	}
+	return zone
+}
+
+// dnsRecordZone returns the zone holding the record name: zone when given,
+// otherwise the longest zone of the current backend holding name, falling
+// back to name without its first label.
+func dnsRecordZone(name string, zone string) (string, error) {
+	name = dns.Fqdn(name)
+	if zone != "" {
+		zone = strings.TrimSuffix(zone, ".")
+		if !dns.IsSubDomain(zone+".", name) {
+			return "", errors.New("zone " + zone + " does not hold " + name)
+		}
+		return zone, nil
+	}
+	zones, err := dnsZoneList()
+	if err != nil {
+		log.Debugf("Failed to list DNS zones for " + name + ": " + err.Error() + " !")
+	} else if zone = longestZone(name, zones); zone != "" {
+		return zone, nil
+	}
+	labels := strings.SplitN(strings.TrimSuffix(name, "."), ".", 2)
+	if len(labels) < 2 {
+		return labels[0], nil
+	}
+	return labels[1], nil
+}
+
+// reverseRecord returns the PTR record name of address and its reverse zone.
+// The zone is the longest of dns.config.reverse.zones, or of the provider
+// zones with dns.config.reverse.discover, holding the record. Otherwise it is
+// cut at dns.config.reverse.ipv4_prefix for IPv4 and at
+// dns.config.reverse.ipv6_prefix for IPv6 (nibble format).
+func reverseRecord(address string) (ptrRecord string, ptrDomain string, err error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", "", errors.New("Invalid IP address: " + address)
+	}
+	ptrRecord, err = dns.ReverseAddr(address)
+	if err != nil {
+		return "", "", err
+	}
+	ptrDomain = longestZone(ptrRecord, viper.GetStringSlice("dns.config.reverse.zones"))
+	if ptrDomain == "" && viper.GetBool("dns.config.reverse.discover") {
+		zones, err := dnsZoneList()
+		if err != nil {
+			log.Debugf("Failed to list DNS zones for reverse zone discovery: " + err.Error() + " !")
+		} else {
+			ptrDomain = longestZone(ptrRecord, zones)
+		}
+	}
+	if ptrDomain != "" {
+		return ptrRecord, ptrDomain, nil
+	}
+	// one label per octet for IPv4, per nibble for IPv6
+	addressLabels, labelBits, prefixKey := 4, 8, "dns.config.reverse.ipv4_prefix"
+	if ip.To4() == nil {
+		addressLabels, labelBits, prefixKey = 32, 4, "dns.config.reverse.ipv6_prefix"
+	}
+	prefix := viper.GetInt(prefixKey)
+	if prefix <= 0 || prefix%labelBits != 0 || prefix/labelBits > addressLabels {
+		return "", "", errors.New("Invalid " + prefixKey + " " + strconv.Itoa(prefix) + ", must be a multiple of " + strconv.Itoa(labelBits))
+	}
+	labels := dns.SplitDomainName(ptrRecord)
+	ptrDomain = strings.Join(labels[addressLabels-prefix/labelBits:], ".")
+	return ptrRecord, ptrDomain, nil
+}
+
+// reverseClassless returns the PTR record name and zone of an IPv4 address
+// inside an RFC 2317 classless delegation from dns.config.reverse.classless,
+// which maps networks to delegated zones, e.g. 10.1.2.0/25: 0/25.2.1.10.in-addr.arpa.
+// The most specific network wins.
+func reverseClassless(address string) (ptrRecord string, ptrDomain string, ok bool) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return "", "", false
+	}
+	bestPrefix := -1
+	for network, zone := range viper.GetStringMapString("dns.config.reverse.classless") {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			log.Debugf("Invalid classless reverse network: " + network + " !")
+			continue
+		}
+		prefix, _ := ipNet.Mask.Size()
+		if ipNet.Contains(ip) && prefix > bestPrefix {
+			bestPrefix = prefix
+			ptrDomain = strings.TrimSuffix(zone, ".")
+		}
+	}
+	if ptrDomain == "" {
+		return "", "", false
+	}
+	return strconv.Itoa(int(ip[3])) + "." + ptrDomain + ".", ptrDomain, true
+}
+
+// dnsAutocreateZones tells whether dns.config.autocreate_zones is enabled,
+// either as true or as a map of zone settings.
+func dnsAutocreateZones() bool {
+	return viper.GetBool("dns.config.autocreate_zones") || len(viper.GetStringMap("dns.config.autocreate_zones")) > 0
+}
+
+// dnsZoneConfig reads the settings of created zones from
+// dns.config.autocreate_zones, with nameservers defaulting to those of the
+// current backend.
+func dnsZoneConfig() dnsZoneSettings {
+	settings := dnsZoneSettings{
+		Kind:        viper.GetString("dns.config.autocreate_zones.kind"),
+		Nameservers: viper.GetStringSlice("dns.config.autocreate_zones.nameservers"),
+		SoaEditApi:  viper.GetString("dns.config.autocreate_zones.soa_edit_api"),
+		Metadata:    make(map[string][]string),
+	}
+	// defaults are set here, a default map would enable autocreate_zones
+	if settings.Kind == "" {
+		settings.Kind = "Master"
+	}
+	if settings.SoaEditApi == "" {
+		settings.SoaEditApi = "INCEPTION-INCREMENT"
+	}
+	if len(settings.Nameservers) == 0 {
+		settings.Nameservers = viper.GetStringSlice(dnsBackendKey("nameservers"))
+	}
+	for kind, value := range viper.GetStringMap("dns.config.autocreate_zones.metadata") {
+		// configuration keys are lowercased, metadata kinds are not
+		kind = strings.ToUpper(kind)
+		switch value := value.(type) {
+		case []interface{}:
+			for _, item := range value {
+				settings.Metadata[kind] = append(settings.Metadata[kind], fmt.Sprint(item))
+			}
+		default:
+			settings.Metadata[kind] = []string{fmt.Sprint(value)}
+		}
+	}
+	return settings
+}
+
+// dnsEnsureZone creates a missing zone when dns.config.autocreate_zones is set.
+func dnsEnsureZone(zone string) {
+	if !dnsAutocreateZones() || zone == "" {
+		return
+	}
+	zones, err := dnsZoneList()
+	if err != nil {
+		log.Debugf("Failed to list DNS zones, NOT creating zone " + zone + ": " + err.Error() + " !")
+		return
+	}
+	for _, existing := range zones {
+		if strings.EqualFold(strings.TrimSuffix(existing, "."), zone) {
+			return
+		}
+	}
+	log.Debugf(noopMsg + "Creating DNS zone: " + zone)
+	if !noop {
+		err = p.CreateZone(zone, dnsZoneConfig())
+		if err != nil {
+			log.Errorf("Failed to create DNS zone " + zone + ": " + err.Error() + " !")
+			return
+		}
+		log.Debugf("Created DNS zone: " + zone)
+	}
+	dnsZones[dnsBackend] = append(dnsZones[dnsBackend], zone)
+}
+
+// powerdnsProvider manages records through the PowerDNS API.
+type powerdnsProvider struct {
+	pdns  *powerdns.Powerdns
+	zones []string
+}
+
+// zone returns the longest existing zone holding the zone hint, or the hint
+// itself. Zones are listed once per provider.
+func (pp *powerdnsProvider) zone(hint string) string {
+	if pp.zones == nil {
+		zones, err := pp.Zones()
+		if err != nil {
+			log.Debugf("PowerDNS: Could not list zones, using zone " + hint)
+			return hint
+		}
+		pp.zones = append(make([]string, 0, len(zones)), zones...)
+	}
+	if zone := longestZone(dns.Fqdn(hint), pp.zones); zone != "" {
+		return zone
+	}
+	log.Debugf("PowerDNS: Could not find zone for " + hint + ", using zone " + hint)
+	return hint
+}
+
+func (pp *powerdnsProvider) Apply(changes []dnsChange) error {
+	var zones []string
+	zoneChanges := make(map[string][]dnsChange)
+	for _, change := range changes {
+		zone := pp.zone(change.Zone)
+		if _, ok := zoneChanges[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		zoneChanges[zone] = append(zoneChanges[zone], change)
+	}
+	for _, zone := range zones {
+		err := pp.apply(zone, zoneChanges[zone])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply patches the zone. Member changes rewrite rrsets from records read
+// before, so a host booting at the same time may drop the value again. The
+// rrsets are read back after a random delay and lost member changes applied
+// again, up to powerdnsMemberRetries times.
+func (pp *powerdnsProvider) apply(zone string, changes []dnsChange) error {
+	err := pp.patch(zone, changes)
+	if err != nil {
+		return err
+	}
+	var members []dnsChange
+	for _, change := range changes {
+		if change.Member {
+			members = append(members, change)
+		}
+	}
+	// seeded per host, so concurrent hosts do not check in lockstep
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 0; len(members) > 0; attempt++ {
+		time.Sleep(time.Duration(500+jitter.Intn(1500)) * time.Millisecond)
+		records, err := pp.Records(zone)
+		if err != nil {
+			return errors.New("Failed to read zone " + zone + ": " + err.Error())
+		}
+		var lost []dnsChange
+		for _, change := range members {
+			if dnsHasMember(records, change) == change.Delete {
+				lost = append(lost, change)
+			}
+		}
+		if len(lost) == 0 {
+			return nil
+		}
+		if attempt == powerdnsMemberRetries {
+			return errors.New("Member records of zone " + zone + " kept being lost to concurrent changes")
+		}
+		log.Debugf("PowerDNS: Member records of zone " + zone + " lost to a concurrent change, applying again")
+		err = pp.patch(zone, lost)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patch applies the changes of zone in one request. Member changes rewrite
+// the rrset from its current records.
+func (pp *powerdnsProvider) patch(zone string, changes []dnsChange) error {
+	var current []dnsRecord
+	for _, change := range changes {
+		if change.Member {
+			records, err := pp.Records(zone)
+			if err != nil {
+				return errors.New("Failed to read zone " + zone + ": " + err.Error())
+			}
+			current = records
+			break
+		}
+	}
+	var keys []string
+	rrsets := make(map[string]map[string]interface{})
+	contents := make(map[string][]string)
+	for _, change := range changes {
+		key := change.Type + " " + change.Name
+		rrset, ok := rrsets[key]
+		if !ok {
+			keys = append(keys, key)
+			rrset = map[string]interface{}{"name": change.Name, "type": change.Type}
+			rrsets[key] = rrset
+			for _, record := range current {
+				if record.Type == change.Type && record.Name == change.Name {
+					contents[key] = append(contents[key], record.Content)
+					rrset["ttl"] = record.Ttl
+				}
+			}
+		}
+		switch {
+		case change.Member:
+			contents[key] = dnsMemberContents(change, contents[key])
+		case change.Delete:
+			contents[key] = nil
+		default:
+			contents[key] = []string{change.Content}
+		}
+		if !change.Delete {
+			rrset["ttl"] = change.Ttl
+		}
+		if change.Comment != "" {
+			rrset["comments"] = []interface{}{map[string]interface{}{
+				"content":     change.Comment,
+				"account":     "stackconf",
+				"modified_at": time.Now().Unix(),
+			}}
+		}
+	}
+	var patch []interface{}
+	for _, key := range keys {
+		rrset := rrsets[key]
+		if len(contents[key]) == 0 {
+			patch = append(patch, map[string]interface{}{"name": rrset["name"], "type": rrset["type"], "changetype": "DELETE"})
+			continue
+		}
+		var records []interface{}
+		for _, content := range contents[key] {
+			records = append(records, map[string]interface{}{"content": content, "disabled": false})
+		}
+		rrset["changetype"] = "REPLACE"
+		rrset["records"] = records
+		patch = append(patch, rrset)
+	}
+	jsonText, err := json.Marshal(map[string]interface{}{"rrsets": patch})
+	if err != nil {
+		return err
+	}
+	err = pp.pdns.Patch("zones/"+powerdnsZoneId(zone), jsonText)
+	if err != nil {
+		return errors.New("Failed to patch zone " + zone + ": " + err.Error())
+	}
+	return nil
+}
+
+// powerdnsMemberRetries bounds the rewrites of member rrsets lost to
+// concurrent changes.
+const powerdnsMemberRetries = 5
+
+func (pp *powerdnsProvider) Records(zone string) ([]dnsRecord, error) {
+	domain, err := pp.pdns.Get("zones/" + powerdnsZoneId(zone))
+	if err != nil {
+		return nil, err
+	}
+	domainMap, ok := domain.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected PowerDNS zone format: " + zone)
+	}
+	var records []dnsRecord
+	rrsets, _ := domainMap["rrsets"].([]interface{})
+	for _, rrset := range rrsets {
+		rrdata := rrset.(map[string]interface{})
+		rrname, _ := rrdata["name"].(string)
+		rrtype, _ := rrdata["type"].(string)
+		rrttl, _ := rrdata["ttl"].(float64)
+		rrrecords, _ := rrdata["records"].([]interface{})
+		var rrcomment string
+		if rrcomments, _ := rrdata["comments"].([]interface{}); len(rrcomments) > 0 {
+			commentData, _ := rrcomments[0].(map[string]interface{})
+			rrcomment, _ = commentData["content"].(string)
+		}
+		for _, rrrecord := range rrrecords {
+			recordData := rrrecord.(map[string]interface{})
+			content, _ := recordData["content"].(string)
+			records = append(records, dnsRecord{Name: rrname, Type: rrtype, Content: content, Ttl: int(rrttl), Comment: rrcomment})
+		}
+	}
+	return records, nil
+}
+
+func (pp *powerdnsProvider) Zones() ([]string, error) {
+	domains, err := pp.pdns.Get("zones")
+	if err != nil {
+		return nil, err
+	}
+	domainsSlice, ok := domains.([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected PowerDNS zones format")
+	}
+	var zones []string
+	for _, domainField := range domainsSlice {
+		domainData := domainField.(map[string]interface{})
+		domainName, _ := domainData["name"].(string)
+		zones = append(zones, strings.TrimSuffix(domainName, "."))
+	}
+	return zones, nil
+}
+
+func (pp *powerdnsProvider) DeleteZone(zone string) error {
+	return pp.pdns.DeleteDomain(powerdnsZoneId(zone))
+}
+
+func (pp *powerdnsProvider) CreateZone(zone string, settings dnsZoneSettings) error {
+	var nameservers []string
+	for _, nameserver := range settings.Nameservers {
+		nameservers = append(nameservers, dns.Fqdn(nameserver))
+	}
+	if nameservers == nil {
+		nameservers = make([]string, 0)
+	}
+	create := map[string]interface{}{
+		"name":        dns.Fqdn(zone),
+		"kind":        settings.Kind,
+		"masters":     make([]string, 0),
+		"nameservers": nameservers,
+	}
+	if settings.SoaEditApi != "" {
+		create["soa_edit_api"] = settings.SoaEditApi
+	}
+	jsonText, err := json.Marshal(create)
+	if err != nil {
+		return err
+	}
+	_, err = pp.pdns.Post("zones", jsonText)
+	if err != nil {
+		return err
+	}
+	if pp.zones != nil {
+		pp.zones = append(pp.zones, zone)
+	}
+	for kind, values := range settings.Metadata {
+		jsonText, err := json.Marshal(map[string]interface{}{"kind": kind, "metadata": values})
+		if err != nil {
+			return err
+		}
+		err = pp.pdns.Put("zones/"+powerdnsZoneId(zone)+"/metadata/"+kind, jsonText)
+		if err != nil {
+			return errors.New("Failed to set zone metadata " + kind + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// powerdnsZoneId escapes a zone name the way PowerDNS builds zone ids.
+func powerdnsZoneId(zone string) string {
+	var id strings.Builder
+	for _, c := range []byte(zone + ".") {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_' {
+			id.WriteByte(c)
+		} else {
+			id.WriteString(fmt.Sprintf("=%02X", c))
+		}
+	}
+	return id.String()
+}
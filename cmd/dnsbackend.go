@@ -0,0 +1,176 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// dnsBackends are the DNS providers by name, configured under dns.backends.
+// Without dns.backends a single backend named default is configured by
+// dns.config.*.
+var dnsBackends map[string]dnsProvider
+
+// dnsBackend names the backend p belongs to.
+var dnsBackend string
+
+// dnsConfigured reports whether any DNS backend is configured.
+func dnsConfigured() bool {
+	return len(viper.GetStringMap("dns.backends")) > 0 || viper.GetString("dns.config.host") != ""
+}
+
+// dnsBackendPrefix returns the configuration prefix of the named backend.
+func dnsBackendPrefix(name string) string {
+	if len(viper.GetStringMap("dns.backends")) == 0 {
+		return "dns.config"
+	}
+	return "dns.backends." + name
+}
+
+// dnsBackendKey returns the configuration key of a current backend setting.
+func dnsBackendKey(key string) string {
+	return dnsBackendPrefix(dnsBackend) + "." + key
+}
+
+// newDnsBackends builds the providers of all configured backends and selects
+// the default one.
+func newDnsBackends() error {
+	dnsBackends = make(map[string]dnsProvider)
+	names := []string{"default"}
+	if backends := viper.GetStringMap("dns.backends"); len(backends) > 0 {
+		names = names[:0]
+		for name := range backends {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		provider, err := newDnsProvider(dnsBackendPrefix(name))
+		if err != nil {
+			return errors.New("DNS backend " + name + ": " + err.Error())
+		}
+		if viper.GetString("dns.config.ownership") == "comment" && !dnsComments(provider) {
+			log.Debugf("DNS backend " + name + " does not keep comments, ownership recorded in TXT records")
+		}
+		dnsBackends[name] = provider
+	}
+	name, err := dnsDefaultBackend()
+	if err != nil {
+		return err
+	}
+	return dnsUse(name)
+}
+
+// dnsBackendNames returns the names of the configured backends, sorted.
+func dnsBackendNames() []string {
+	var names []string
+	for name := range dnsBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dnsDefaultBackend returns dns.config.backend, or the backend named default,
+// or the only backend.
+func dnsDefaultBackend() (string, error) {
+	if name := viper.GetString("dns.config.backend"); name != "" {
+		return name, nil
+	}
+	if _, ok := dnsBackends["default"]; ok {
+		return "default", nil
+	}
+	if len(dnsBackends) == 1 {
+		return dnsBackendNames()[0], nil
+	}
+	return "", errors.New("DNS default backend not set in dns.config.backend")
+}
+
+// dnsUse makes the named backend the current one.
+func dnsUse(name string) error {
+	provider, ok := dnsBackends[name]
+	if !ok {
+		return errors.New("DNS backend not found: " + name)
+	}
+	p = provider
+	dnsBackend = name
+	return nil
+}
+
+// dnsTargets returns the backends a record of family is written to: the
+// backend field of the record, a name or a list of names, then
+// dns.target.<family>, then the default backend.
+func dnsTargets(family string, hash map[string]interface{}) []string {
+	switch backend := hash["backend"].(type) {
+	case string:
+		return []string{backend}
+	case []interface{}:
+		var targets []string
+		for _, name := range backend {
+			targets = append(targets, fmt.Sprint(name))
+		}
+		return targets
+	}
+	if targets := viper.GetStringSlice("dns.target." + family); len(targets) > 0 {
+		return targets
+	}
+	name, err := dnsDefaultBackend()
+	if err != nil {
+		log.Debugf(err.Error() + " !")
+		return nil
+	}
+	return []string{name}
+}
+
+// dnsForTargets runs fn with each backend of family as the current one.
+func dnsForTargets(family string, hash map[string]interface{}, fn func()) {
+	for _, name := range dnsTargets(family, hash) {
+		err := dnsUse(name)
+		if err != nil {
+			log.Errorf(err.Error() + " !")
+			continue
+		}
+		fn()
+	}
+}
+
+// dnsTargeted wraps a dns.record.<family> handler for doMetaSliceMap to run
+// against every target backend of the record.
+func dnsTargeted(family string, fn func(map[string]interface{})) func(map[string]interface{}) {
+	return func(hash map[string]interface{}) {
+		dnsForTargets(family, hash, func() {
+			fn(hash)
+		})
+	}
+}
+
+// dnsTargetedSlice wraps a dns.record.<family> handler for doMetaSlice to run
+// against every target backend of the family.
+func dnsTargetedSlice(family string, fn func(string)) func(string) {
+	return func(value string) {
+		dnsForTargets(family, nil, func() {
+			fn(value)
+		})
+	}
+}
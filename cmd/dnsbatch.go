@@ -0,0 +1,93 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// With dns.config.batch, rrset changes are queued between dnsBegin and
+// dnsCommit and applied together, in one atomic request per zone.
+// Changes are queued per backend.
+var dnsBatch []dnsQueued
+var dnsBatching bool
+
+type dnsQueued struct {
+	backend string
+	change  dnsChange
+}
+
+// dnsBegin starts queueing rrset changes.
+func dnsBegin() {
+	dnsBatch = nil
+	dnsBatching = viper.GetBool("dns.config.batch")
+}
+
+// dnsQueue queues the change, or applies it right away without batching.
+// A later change of the same rrset of the current backend replaces the queued
+// ones, a later member change only the queued change of the same member.
+func dnsQueue(change dnsChange) error {
+	if !dnsBatching {
+		return p.Apply([]dnsChange{change})
+	}
+	var queue []dnsQueued
+	for _, queued := range dnsBatch {
+		if queued.backend == dnsBackend && queued.change.Type == change.Type && queued.change.Name == change.Name &&
+			(!change.Member || queued.change.Member && dnsSameContent(change.Type, queued.change.Content, change.Content)) {
+			continue
+		}
+		queue = append(queue, queued)
+	}
+	dnsBatch = append(queue, dnsQueued{backend: dnsBackend, change: change})
+	return nil
+}
+
+// dnsCommit applies the queued changes of each backend and stops queueing.
+// A failing backend does not keep the others from applying.
+func dnsCommit() error {
+	queue := dnsBatch
+	dnsBatch = nil
+	dnsBatching = false
+	var backends []string
+	changes := make(map[string][]dnsChange)
+	for _, queued := range queue {
+		if _, ok := changes[queued.backend]; !ok {
+			backends = append(backends, queued.backend)
+		}
+		changes[queued.backend] = append(changes[queued.backend], queued.change)
+	}
+	var failed []string
+	for _, backend := range backends {
+		log.Debugf("Applying " + strconv.Itoa(len(changes[backend])) + " DNS changes to backend " + backend)
+		err := dnsBackends[backend].Apply(changes[backend])
+		if err != nil {
+			failed = append(failed, backend+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
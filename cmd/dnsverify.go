@@ -0,0 +1,117 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// dnsUpdated lists the records written in this run per backend, for
+// propagation checks.
+var dnsUpdated = make(map[string][]dnsRecord)
+
+// dnsVerifyNameservers returns the verify_nameservers of the current backend,
+// defaulting to its nameservers, as host:port addresses.
+func dnsVerifyNameservers() (servers []string) {
+	nameservers := viper.GetStringSlice(dnsBackendKey("verify_nameservers"))
+	if len(nameservers) == 0 {
+		nameservers = viper.GetStringSlice(dnsBackendKey("nameservers"))
+	}
+	for _, nameserver := range nameservers {
+		nameserver = strings.TrimSuffix(nameserver, ".")
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			nameserver = net.JoinHostPort(nameserver, "53")
+		}
+		servers = append(servers, nameserver)
+	}
+	return servers
+}
+
+// dnsVerify queries every nameserver for the records until all of them
+// resolve to the expected content, failing after timeout.
+func dnsVerify(nameservers []string, records []dnsRecord, timeout time.Duration, interval time.Duration) error {
+	if len(nameservers) == 0 {
+		return errors.New("no nameservers to verify")
+	}
+	client := &dns.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+	resolved := make(map[string]bool)
+	for {
+		var pending []string
+		for _, nameserver := range nameservers {
+			for _, record := range records {
+				key := record.Type + " " + record.Name + " " + record.Content + " @" + nameserver
+				if resolved[key] {
+					continue
+				}
+				ok, err := dnsResolves(client, nameserver, record)
+				if err != nil {
+					log.Debugf("DNS query failed, " + key + ": " + err.Error())
+				}
+				if ok {
+					resolved[key] = true
+				} else {
+					pending = append(pending, key)
+				}
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		log.Debugf("Waiting for DNS records: " + strings.Join(pending, ", "))
+		if time.Now().Add(interval).After(deadline) {
+			return errors.New("DNS records not resolvable within " + timeout.String() + ": " + strings.Join(pending, ", "))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// dnsResolves reports whether the nameserver answers the record name and type
+// with the record content.
+func dnsResolves(client *dns.Client, nameserver string, record dnsRecord) (bool, error) {
+	expected, err := dns.NewRR(record.Name + " 0 IN " + record.Type + " " + record.Content)
+	if err != nil {
+		return false, err
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(record.Name), expected.Header().Rrtype)
+	r, _, err := client.Exchange(m, nameserver)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == expected.Header().Rrtype && strings.EqualFold(dnsRdata(rr), dnsRdata(expected)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dnsRdata returns the presentation format of the record data.
+func dnsRdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testVerifyHandler answers web.dev5.lan A and AAAA queries.
+func testVerifyHandler(s *testDnsServer, w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, record := range []string{"web.dev5.lan. 60 IN A 10.1.2.5", "web.dev5.lan. 60 IN AAAA 2001:db8::5"} {
+		rr, _ := dns.NewRR(record)
+		if rr.Header().Name == r.Question[0].Name && rr.Header().Rrtype == r.Question[0].Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestDnsVerifyResolved(t *testing.T) {
+	s := startTestDnsServer(t, testVerifyHandler)
+	records := []dnsRecord{
+		{Name: "web.dev5.lan.", Type: "A", Content: "10.1.2.5", Ttl: 60},
+		{Name: "web.dev5.lan.", Type: "AAAA", Content: "2001:DB8:0::5", Ttl: 60},
+	}
+	err := dnsVerify([]string{s.addr}, records, time.Second, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDnsVerifyTimeout(t *testing.T) {
+	s := startTestDnsServer(t, testVerifyHandler)
+	records := []dnsRecord{
+		{Name: "web.dev5.lan.", Type: "A", Content: "10.1.2.5", Ttl: 60},
+		{Name: "web.dev5.lan.", Type: "A", Content: "10.1.2.9", Ttl: 60},
+		{Name: "missing.dev5.lan.", Type: "A", Content: "10.1.2.6", Ttl: 60},
+	}
+	err := dnsVerify([]string{s.addr}, records, 300*time.Millisecond, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("wrong and missing records verified")
+	}
+	for _, pending := range []string{"A web.dev5.lan. 10.1.2.9 @" + s.addr, "A missing.dev5.lan. 10.1.2.6 @" + s.addr} {
+		if !strings.Contains(err.Error(), pending) {
+			t.Errorf("error %q does not list %s", err, pending)
+		}
+	}
+	if strings.Contains(err.Error(), "10.1.2.5") {
+		t.Errorf("error %q lists the resolved record", err)
+	}
+	if !strings.HasPrefix(err.Error(), "DNS records not resolvable within 300ms") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
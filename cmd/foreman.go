@@ -0,0 +1,293 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// foremanClient talks to the Foreman API. It mirrors the go-foreman client,
+// but supports personal access tokens, client certificates and CA bundles.
+type foremanClient struct {
+	Hostname string
+	BaseURL  string
+	client   *http.Client
+	auth     string
+}
+
+var foremanSearchRetries = []time.Duration{5 * time.Second, 15 * time.Second, 60 * time.Second}
+
+// newForeman builds a Foreman client from foreman.config.* settings.
+func newForeman() (*foremanClient, error) {
+	fc := new(foremanClient)
+	fc.Hostname = viper.GetString("foreman.config.host")
+	fc.BaseURL = "https://" + fc.Hostname + "/api/"
+
+	username := viper.GetString("foreman.config.username")
+	password := viper.GetString("foreman.config.password")
+	token := viper.GetString("foreman.config.token")
+	if token != "" {
+		// Personal access tokens replace the password in basic auth
+		if username == "" {
+			return nil, errors.New("Foreman token requires foreman.config.username")
+		}
+		log.Debugf("Foreman authentication: personal access token")
+		password = token
+	}
+	if username != "" {
+		fc.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	// certificates are verified against system CAs or ca_file, unless
+	// verify_ssl is explicitly disabled
+	tlsConfig := &tls.Config{InsecureSkipVerify: !viper.GetBool("foreman.config.verify_ssl")}
+	if tlsConfig.InsecureSkipVerify {
+		log.Warningf("Foreman certificate verification disabled by foreman.config.verify_ssl !")
+	}
+	caFile := viper.GetString("foreman.config.ca_file")
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.New("Failed to read foreman CA file " + caFile + ": " + err.Error())
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("No certificates found in foreman CA file " + caFile)
+		}
+		tlsConfig.RootCAs = caPool
+		tlsConfig.InsecureSkipVerify = false
+	}
+	clientCert := viper.GetString("foreman.config.client_cert")
+	clientKey := viper.GetString("foreman.config.client_key")
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.New("Failed to load foreman client certificate: " + err.Error())
+		}
+		log.Debugf("Foreman authentication: client certificate " + clientCert)
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if fc.auth == "" && len(tlsConfig.Certificates) == 0 {
+		log.Debugf("Foreman credentials not configured !")
+	}
+	fc.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   time.Duration(viper.GetInt("foreman.config.timeout")) * time.Second,
+	}
+	return fc, nil
+}
+
+func (fc *foremanClient) request(method string, endpoint string, jsonData []byte) (interface{}, error) {
+	var data interface{}
+	req, err := http.NewRequest(method, fc.BaseURL+endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	if fc.auth != "" {
+		req.Header.Add("Authorization", fc.auth)
+	}
+	r, err := fc.client.Do(req)
+	if err != nil {
+		log.Debugf("Foreman " + method + " " + endpoint + " failed: " + err.Error())
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return nil, errors.New("HTTP Error " + r.Status)
+	}
+	response, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Debugf("Error while reading foreman response body !")
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(response, &data)
+	if err != nil {
+		log.Debugf("Error while processing foreman JSON !")
+		return nil, err
+	}
+	return data, nil
+}
+
+func (fc *foremanClient) requestMap(method string, endpoint string, jsonData []byte) (map[string]interface{}, error) {
+	data, err := fc.request(method, endpoint, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := data.(map[string]interface{})
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	return m, nil
+}
+
+func (fc *foremanClient) Get(endpoint string) (map[string]interface{}, error) {
+	return fc.requestMap("GET", endpoint, nil)
+}
+
+func (fc *foremanClient) Post(endpoint string, jsonData []byte) (map[string]interface{}, error) {
+	return fc.requestMap("POST", endpoint, jsonData)
+}
+
+func (fc *foremanClient) Put(endpoint string, jsonData []byte) (map[string]interface{}, error) {
+	return fc.requestMap("PUT", endpoint, jsonData)
+}
+
+func (fc *foremanClient) Delete(endpoint string) (map[string]interface{}, error) {
+	return fc.requestMap("DELETE", endpoint, nil)
+}
+
+func (fc *foremanClient) DeleteHost(hostId string) error {
+	_, err := fc.Delete("hosts/" + hostId)
+	return err
+}
+
+func (fc *foremanClient) search(resource string, search string) (map[string]interface{}, error) {
+	endpoint := resource + "?search=" + url.QueryEscape(search) + "&per_page=10000"
+	data, err := fc.Get(endpoint)
+	for _, delay := range foremanSearchRetries {
+		if err == nil {
+			break
+		}
+		log.Debugf("Error searching for " + resource + ", retry in " + strconv.Itoa(int(delay.Seconds())) + "s: " + err.Error())
+		time.Sleep(delay)
+		data, err = fc.Get(endpoint)
+	}
+	if err != nil {
+		log.Debugf("Error searching for " + resource + ", failing")
+		return nil, err
+	}
+	return data, nil
+}
+
+func matchResource(data map[string]interface{}, query string) (map[string]interface{}, error) {
+	resultSlice, _ := data["results"].([]interface{})
+	for _, field := range []string{"title", "name"} {
+		for _, resultItem := range resultSlice {
+			resultData := resultItem.(map[string]interface{})
+			if value, ok := resultData[field]; ok && value == query {
+				return resultData, nil
+			}
+		}
+	}
+	return nil, errors.New("Resource not found")
+}
+
+// SearchResource returns the resource whose title or name equals query.
+func (fc *foremanClient) SearchResource(resource string, query string) (map[string]interface{}, error) {
+	data, err := fc.search(resource, query)
+	if err != nil {
+		return nil, err
+	}
+	return matchResource(data, query)
+}
+
+// SearchResourceName is SearchResource narrowed to a name search.
+func (fc *foremanClient) SearchResourceName(resource string, query string) (map[string]interface{}, error) {
+	data, err := fc.search(resource, "name~"+query)
+	if err != nil {
+		return nil, err
+	}
+	return matchResource(data, query)
+}
+
+// SearchAnyResource returns the raw search result, failing when it is empty.
+func (fc *foremanClient) SearchAnyResource(resource string, query string) (map[string]interface{}, error) {
+	data, err := fc.search(resource, query)
+	if err != nil {
+		return nil, err
+	}
+	resultSlice, _ := data["results"].([]interface{})
+	if len(resultSlice) < 1 {
+		return nil, errors.New("Resource not found")
+	}
+	return data, nil
+}
+
+// SearchResourceTitle returns the only resource whose full title equals
+// title, falling back to a unique name match. Several matches are an error.
+func (fc *foremanClient) SearchResourceTitle(resource string, title string) (map[string]interface{}, error) {
+	data, err := fc.search(resource, "title=\""+title+"\"")
+	if err != nil {
+		return nil, err
+	}
+	matches := filterResource(data, "title", title)
+	if len(matches) == 0 {
+		data, err = fc.search(resource, "name=\""+title+"\"")
+		if err != nil {
+			return nil, err
+		}
+		matches = filterResource(data, "name", title)
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("Resource not found")
+	}
+	if len(matches) > 1 {
+		var titles []string
+		for _, match := range matches {
+			matchTitle, _ := match["title"].(string)
+			titles = append(titles, matchTitle)
+		}
+		return nil, errors.New("Multiple " + resource + " match " + title + ": " + strings.Join(titles, ", "))
+	}
+	return matches[0], nil
+}
+
+func filterResource(data map[string]interface{}, field string, value string) (matches []map[string]interface{}) {
+	resultSlice, _ := data["results"].([]interface{})
+	for _, resultItem := range resultSlice {
+		resultData := resultItem.(map[string]interface{})
+		if resultData[field] == value {
+			matches = append(matches, resultData)
+		}
+	}
+	return matches
+}
+
+// SearchHostUuid returns the host linked to the given compute instance uuid.
+func (fc *foremanClient) SearchHostUuid(uuid string) (map[string]interface{}, error) {
+	data, err := fc.search("hosts", "uuid = "+uuid)
+	if err != nil {
+		return nil, err
+	}
+	matches := filterResource(data, "uuid", uuid)
+	if len(matches) != 1 {
+		return nil, errors.New("Host not found for uuid " + uuid)
+	}
+	return matches[0], nil
+}
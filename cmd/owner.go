@@ -0,0 +1,227 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DNS record ownership is selected by dns.config.ownership. With txt every
+// rrset written by stackconf gets a companion TXT record, with comment it gets
+// a PowerDNS rrset comment. Without ownership every record is deletable.
+
+const dnsOwnerPrefix = "_stackconf-"
+
+type dnsOwner struct {
+	owner string
+	stack string
+}
+
+func dnsOwnership() string {
+	ownership := viper.GetString("dns.config.ownership")
+	if ownership == "comment" && !dnsComments(p) {
+		return "txt"
+	}
+	return ownership
+}
+
+// dnsComments reports whether the provider keeps rrset comments. Ownership
+// comments fall back to TXT records on providers without comments.
+func dnsComments(provider dnsProvider) bool {
+	_, ok := provider.(*powerdnsProvider)
+	return ok
+}
+
+// dnsOwnerContent describes the current host as owner of a record.
+func dnsOwnerContent() string {
+	return "heritage=stackconf,owner=" + hostFqdn + ",stack=" + stackenv
+}
+
+// dnsOwnerName is the companion TXT record name of the name/dtype rrset.
+func dnsOwnerName(dtype string, name string) string {
+	return dnsOwnerPrefix + strings.ToLower(dtype) + "." + name
+}
+
+// dnsUpdate replaces the name/dtype rrset and records its ownership.
+func dnsUpdate(zone string, dtype string, name string, content string, ttl int) error {
+	return dnsUpdateChange(dnsChange{Zone: zone, Type: dtype, Name: name, Content: content, Ttl: ttl})
+}
+
+// dnsUpdateMember adds content to the name/dtype rrset, keeping the records
+// other hosts added, and records its ownership.
+func dnsUpdateMember(zone string, dtype string, name string, content string, ttl int) error {
+	return dnsUpdateChange(dnsChange{Zone: zone, Type: dtype, Name: name, Content: content, Ttl: ttl, Member: true})
+}
+
+// dnsUpdateChange queues the rrset change and records its ownership.
+func dnsUpdateChange(change dnsChange) error {
+	switch ownership := dnsOwnership(); ownership {
+	case "", "txt":
+	case "comment":
+		change.Comment = dnsOwnerContent()
+	default:
+		log.Debugf("Unknown DNS ownership " + ownership + ", ownership not recorded !")
+	}
+	err := dnsQueue(change)
+	if err != nil {
+		return err
+	}
+	dnsUpdated[dnsBackend] = append(dnsUpdated[dnsBackend], dnsRecord{Name: change.Name, Type: change.Type, Content: change.Content, Ttl: change.Ttl})
+	if dnsOwnership() == "txt" {
+		err = dnsQueue(dnsChange{Zone: change.Zone, Type: "TXT", Name: dnsOwnerName(change.Type, change.Name), Content: dnsQuote(dnsOwnerContent()), Ttl: change.Ttl})
+		if err != nil {
+			log.Debugf("Failed to record ownership of " + change.Type + " record " + change.Name + ": " + err.Error() + " !")
+		}
+	}
+	return nil
+}
+
+// dnsDelete removes the name/dtype rrset with its ownership record.
+func dnsDelete(zone string, dtype string, name string) error {
+	err := dnsQueue(dnsChange{Zone: zone, Type: dtype, Name: name, Delete: true})
+	if err != nil {
+		return err
+	}
+	if dnsOwnership() == "txt" {
+		err = dnsQueue(dnsChange{Zone: zone, Type: "TXT", Name: dnsOwnerName(dtype, name), Delete: true})
+		if err != nil {
+			log.Debugf("Failed to delete ownership of " + dtype + " record " + name + ": " + err.Error() + " !")
+		}
+	}
+	return nil
+}
+
+// dnsDeleteMember removes content from the name/dtype rrset, keeping the
+// records of other hosts. The ownership record is removed with the last
+// record of the rrset.
+func dnsDeleteMember(zone string, dtype string, name string, content string) error {
+	err := dnsQueue(dnsChange{Zone: zone, Type: dtype, Name: name, Content: content, Delete: true, Member: true})
+	if err != nil {
+		return err
+	}
+	if dnsOwnership() != "txt" {
+		return nil
+	}
+	records, err := dnsZoneRecords(zone)
+	if err != nil {
+		log.Debugf("Failed to list zone " + zone + ", keeping ownership of " + dtype + " record " + name + " !")
+		return nil
+	}
+	for _, record := range records {
+		if record.Type == dtype && record.Name == name && !dnsSameContent(dtype, record.Content, content) {
+			return nil
+		}
+	}
+	err = dnsQueue(dnsChange{Zone: zone, Type: "TXT", Name: dnsOwnerName(dtype, name), Delete: true})
+	if err != nil {
+		log.Debugf("Failed to delete ownership of " + dtype + " record " + name + ": " + err.Error() + " !")
+	}
+	return nil
+}
+
+// dnsOwners collects ownership of the listed records, keyed by type and name.
+func dnsOwners(records []dnsRecord) map[string]dnsOwner {
+	owners := make(map[string]dnsOwner)
+	for _, record := range records {
+		switch dnsOwnership() {
+		case "txt":
+			if record.Type != "TXT" || !strings.HasPrefix(record.Name, dnsOwnerPrefix) {
+				continue
+			}
+			split := strings.SplitN(strings.TrimPrefix(record.Name, dnsOwnerPrefix), ".", 2)
+			if len(split) != 2 {
+				continue
+			}
+			if owner, ok := parseDnsOwner(strings.Trim(record.Content, "\"")); ok {
+				owners[strings.ToUpper(split[0])+" "+split[1]] = owner
+			}
+		case "comment":
+			if owner, ok := parseDnsOwner(record.Comment); ok {
+				owners[record.Type+" "+record.Name] = owner
+			}
+		}
+	}
+	return owners
+}
+
+func parseDnsOwner(content string) (owner dnsOwner, ok bool) {
+	for _, field := range strings.Split(content, ",") {
+		split := strings.SplitN(field, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		switch split[0] {
+		case "heritage":
+			ok = split[1] == "stackconf"
+		case "owner":
+			owner.owner = split[1]
+		case "stack":
+			owner.stack = split[1]
+		}
+	}
+	return owner, ok
+}
+
+// dnsOwned reports whether stackconf may delete the name/dtype rrset, owned
+// by host when host is set. Without ownership tracking every rrset is owned.
+func dnsOwned(owners map[string]dnsOwner, dtype string, name string, host string) bool {
+	if dnsOwnership() == "" {
+		return true
+	}
+	owner, ok := owners[dtype+" "+name]
+	return ok && (host == "" || owner.owner == host)
+}
+
+// dnsZoneOwners returns ownership of the zone records.
+func dnsZoneOwners(zone string) (map[string]dnsOwner, error) {
+	records, err := dnsZoneRecords(zone)
+	if err != nil {
+		return nil, err
+	}
+	return dnsOwners(records), nil
+}
+
+// dnsDeleteOwned removes the name/dtype rrset unless ownership tracking shows
+// it is not owned by the current host.
+func dnsDeleteOwned(zone string, dtype string, name string) {
+	if dnsOwnership() != "" {
+		owners, err := dnsZoneOwners(zone)
+		if err != nil {
+			log.Debugf("Failed to read ownership of zone " + zone + ", NOT deleting " + dtype + " record " + name + " !")
+			return
+		}
+		if !dnsOwned(owners, dtype, name, hostFqdn) {
+			log.Debugf("Not owned by " + hostFqdn + ", NOT deleting " + dtype + " record, domain: " + zone + ", name: " + name + " !")
+			return
+		}
+	}
+	log.Debugf(noopMsg + "Deleting " + dtype + " record, domain: " + zone + ", name: " + name + " !")
+	if !noop {
+		err := dnsDelete(zone, dtype, name)
+		if err != nil {
+			log.Debugf("Failed to delete " + dtype + " record, domain: " + zone + ", name: " + name + " !")
+			return
+		}
+		log.Debugf("Deleted " + dtype + " record, domain: " + zone + ", name: " + name + " !")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// runReport collects the steps of a stackconf run, so it can be posted to
+// Foreman as a config report.
+type runReport struct {
+	mu      sync.Mutex
+	start   time.Time
+	steps   []*reportStep
+	current *reportStep
+}
+
+type reportStep struct {
+	name     string
+	start    time.Time
+	duration time.Duration
+	failed   bool
+	logs     []reportLog
+}
+
+type reportLog struct {
+	level   string
+	message string
+}
+
+var stackconfReport *runReport
+
+func newRunReport() *runReport {
+	return &runReport{start: time.Now()}
+}
+
+// startStep closes the current step and opens a new one.
+func (r *runReport) startStep(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeStep()
+	r.current = &reportStep{name: name, start: time.Now()}
+	r.steps = append(r.steps, r.current)
+}
+
+// endStep closes the current step.
+func (r *runReport) endStep() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeStep()
+}
+
+func (r *runReport) closeStep() {
+	if r.current != nil {
+		r.current.duration = time.Since(r.current.start)
+		r.current = nil
+	}
+}
+
+// failStep marks the current step as failed, or adds a failed step when no
+// step is open. Error logs alone do not fail a step, as retried operations
+// log errors too.
+func (r *runReport) failStep(message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	step := r.current
+	if step == nil {
+		step = &reportStep{name: "Stackconf", start: time.Now()}
+		r.steps = append(r.steps, step)
+	}
+	step.logs = append(step.logs, reportLog{level: "err", message: message})
+	step.failed = true
+}
+
+func (r *runReport) addLog(level string, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return
+	}
+	r.current.logs = append(r.current.logs, reportLog{level: level, message: message})
+}
+
+// configReport renders the run in the Foreman config_reports format.
+func (r *runReport) configReport(host string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeStep()
+	var failed int
+	times := map[string]float64{"total": time.Since(r.start).Seconds()}
+	logs := make([]interface{}, 0)
+	for _, step := range r.steps {
+		status := "success"
+		level := "notice"
+		if step.failed {
+			status = "failed"
+			level = "err"
+			failed++
+		}
+		times[step.name] = step.duration.Seconds()
+		source := map[string]string{"source": "Stackconf/" + step.name}
+		for _, l := range step.logs {
+			logs = append(logs, map[string]interface{}{"log": map[string]interface{}{
+				"sources":  source,
+				"messages": map[string]string{"message": l.message},
+				"level":    l.level,
+			}})
+		}
+		logs = append(logs, map[string]interface{}{"log": map[string]interface{}{
+			"sources":  source,
+			"messages": map[string]string{"message": step.name + " " + status + " in " + step.duration.Round(time.Second).String()},
+			"level":    level,
+		}})
+	}
+	report := map[string]interface{}{"config_report": map[string]interface{}{
+		"host":        host,
+		"reported_at": time.Now().UTC().Format("2006-01-02 15:04:05 UTC"),
+		"status": map[string]int{
+			"applied":         0,
+			"restarted":       0,
+			"failed":          failed,
+			"failed_restarts": 0,
+			"skipped":         0,
+			"pending":         0,
+		},
+		"metrics": map[string]interface{}{
+			"time":      times,
+			"resources": map[string]int{"total": len(r.steps)},
+		},
+		"logs": logs,
+	}}
+	return json.Marshal(report)
+}
+
+// reportWriter copies log messages of INFO and above into the current
+// report step.
+type reportWriter struct{}
+
+func (reportWriter) Write(entry loggo.Entry) {
+	if entry.Level < loggo.INFO {
+		return
+	}
+	level := "info"
+	switch {
+	case entry.Level >= loggo.ERROR:
+		level = "err"
+	case entry.Level == loggo.WARNING:
+		level = "warning"
+	}
+	stackconfReport.addLog(level, entry.Message)
+}
+
+func foremanSubmitReport(host string) {
+	if stackconfReport == nil {
+		return
+	}
+	jsonText, err := stackconfReport.configReport(host)
+	if err != nil {
+		log.Errorf("Failed to build foreman config report: " + err.Error())
+		return
+	}
+	_, err = f.Post("config_reports", jsonText)
+	if err != nil {
+		log.Errorf("Failed to submit foreman config report: " + err.Error())
+		return
+	}
+	log.Debugf("Foreman config report submitted, host: " + host)
+}
@@ -0,0 +1,213 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rfc2136Provider manages records with RFC 2136 dynamic updates, signed with
+// a TSIG key when one is configured. Zone listing is not part of the protocol,
+// so zones come from configuration, and records are read by zone transfer.
+type rfc2136Provider struct {
+	server        string
+	tsigName      string
+	tsigSecret    string
+	tsigAlgorithm string
+	zones         []string
+	client        *dns.Client
+}
+
+func newRfc2136Provider(server string, tsigName string, tsigSecret string, tsigAlgorithm string, zones []string) (dnsProvider, error) {
+	if server == "" {
+		return nil, errors.New("DNS server not found")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	rp := &rfc2136Provider{
+		server: server,
+		zones:  zones,
+		client: &dns.Client{Timeout: 10 * time.Second},
+	}
+	if tsigName != "" {
+		if tsigSecret == "" {
+			return nil, errors.New("TSIG secret not found for key " + tsigName)
+		}
+		if tsigAlgorithm == "" {
+			tsigAlgorithm = dns.HmacSHA256
+		}
+		rp.tsigName = dns.Fqdn(tsigName)
+		rp.tsigSecret = tsigSecret
+		rp.tsigAlgorithm = dns.Fqdn(tsigAlgorithm)
+		rp.client.TsigSecret = map[string]string{rp.tsigName: tsigSecret}
+	}
+	return rp, nil
+}
+
+func (rp *rfc2136Provider) sign(m *dns.Msg) {
+	if rp.tsigName != "" {
+		m.SetTsig(rp.tsigName, rp.tsigAlgorithm, 300, time.Now().Unix())
+	}
+}
+
+func (rp *rfc2136Provider) exchange(m *dns.Msg) (*dns.Msg, error) {
+	rp.sign(m)
+	r, _, err := rp.client.Exchange(m, rp.server)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return r, errors.New("DNS server " + rp.server + " returned " + dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// findZone returns the zone holding name, from configured zones or SOA lookup.
+func (rp *rfc2136Provider) findZone(name string, hint string) string {
+	var zone string
+	for _, configured := range rp.zones {
+		if dns.IsSubDomain(dns.Fqdn(configured), name) && len(configured) > len(zone) {
+			zone = configured
+		}
+	}
+	if zone != "" {
+		return strings.TrimSuffix(zone, ".")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSOA)
+	r, _, err := rp.client.Exchange(m, rp.server)
+	if err == nil {
+		for _, rr := range append(r.Answer, r.Ns...) {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return strings.TrimSuffix(soa.Hdr.Name, ".")
+			}
+		}
+	}
+	log.Debugf("RFC2136: Could not find zone for " + name + ", reverting to zone " + hint)
+	return hint
+}
+
+func (rp *rfc2136Provider) Apply(changes []dnsChange) error {
+	var zones []string
+	updates := make(map[string]*dns.Msg)
+	for _, change := range changes {
+		zone := dns.Fqdn(rp.findZone(change.Name, change.Zone))
+		m, ok := updates[zone]
+		if !ok {
+			m = new(dns.Msg)
+			m.SetUpdate(zone)
+			updates[zone] = m
+			zones = append(zones, zone)
+		}
+		if change.Member {
+			// single record updates are applied atomically by the server
+			rr, err := dns.NewRR(change.Name + " " + strconv.Itoa(change.Ttl) + " IN " + change.Type + " " + change.Content)
+			if err != nil {
+				return err
+			}
+			if change.Delete {
+				m.Remove([]dns.RR{rr})
+			} else {
+				m.Insert([]dns.RR{rr})
+			}
+			continue
+		}
+		if change.Delete {
+			rrtype, ok := dns.StringToType[change.Type]
+			if !ok {
+				return errors.New("Unknown record type " + change.Type)
+			}
+			m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: change.Name, Rrtype: rrtype, Class: dns.ClassINET}}})
+			continue
+		}
+		if change.Comment != "" {
+			log.Debugf("RFC2136: Record comments are not supported, skipping comment of " + change.Name)
+		}
+		rr, err := dns.NewRR(change.Name + " " + strconv.Itoa(change.Ttl) + " IN " + change.Type + " " + change.Content)
+		if err != nil {
+			return err
+		}
+		m.RemoveRRset([]dns.RR{rr})
+		m.Insert([]dns.RR{rr})
+	}
+	for _, zone := range zones {
+		_, err := rp.exchange(updates[zone])
+		if err != nil {
+			return errors.New("Failed to update zone " + zone + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (rp *rfc2136Provider) Records(zone string) ([]dnsRecord, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+	rp.sign(m)
+	t := new(dns.Transfer)
+	t.TsigSecret = rp.client.TsigSecret
+	envelopes, err := t.In(m, rp.server)
+	if err != nil {
+		return nil, err
+	}
+	var records []dnsRecord
+	var soaSeen bool
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			hdr := rr.Header()
+			// zone transfer ends with a repeated SOA
+			if hdr.Rrtype == dns.TypeSOA {
+				if soaSeen {
+					continue
+				}
+				soaSeen = true
+			}
+			records = append(records, dnsRecord{
+				Name:    hdr.Name,
+				Type:    dns.TypeToString[hdr.Rrtype],
+				Content: dnsRdata(rr),
+				Ttl:     int(hdr.Ttl),
+			})
+		}
+	}
+	return records, nil
+}
+
+func (rp *rfc2136Provider) Zones() ([]string, error) {
+	return rp.zones, nil
+}
+
+func (rp *rfc2136Provider) DeleteZone(zone string) error {
+	return errors.New("Zone deletion is not supported by RFC 2136 provider, zone: " + zone)
+}
+
+func (rp *rfc2136Provider) CreateZone(zone string, settings dnsZoneSettings) error {
+	return errors.New("Zone creation is not supported by RFC 2136 provider, zone: " + zone)
+}
@@ -0,0 +1,204 @@
+// Copyright © 2017 Zdenek Janda <zdenek.janda@cloudevelops.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testTsigName = "stackconf."
+const testTsigSecret = "c3RhY2tjb25mIHRlc3Qgc2VjcmV0"
+
+// testDnsServer is a local DNS server accepting TSIG signed updates and
+// zone transfers on the same port.
+type testDnsServer struct {
+	addr    string
+	mu      sync.Mutex
+	updates []*dns.Msg
+	axfr    []dns.RR
+	udp     *dns.Server
+	tcp     *dns.Server
+}
+
+func startTestDnsServer(t *testing.T, handler func(s *testDnsServer, w dns.ResponseWriter, r *dns.Msg)) *testDnsServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	s := &testDnsServer{addr: listener.Addr().String()}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		handler(s, w, r)
+	})
+	secrets := map[string]string{testTsigName: testTsigSecret}
+	accept := func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	started := make(chan struct{}, 2)
+	notify := func() { started <- struct{}{} }
+	s.udp = &dns.Server{PacketConn: packetConn, Handler: mux, TsigSecret: secrets, MsgAcceptFunc: accept, NotifyStartedFunc: notify}
+	s.tcp = &dns.Server{Listener: listener, Handler: mux, TsigSecret: secrets, MsgAcceptFunc: accept, NotifyStartedFunc: notify}
+	go s.udp.ActivateAndServe()
+	go s.tcp.ActivateAndServe()
+	<-started
+	<-started
+	t.Cleanup(func() {
+		s.udp.Shutdown()
+		s.tcp.Shutdown()
+	})
+	return s
+}
+
+// testRfc2136Handler records signed updates and serves the AXFR records.
+func testRfc2136Handler(t *testing.T) func(s *testDnsServer, w dns.ResponseWriter, r *dns.Msg) {
+	return func(s *testDnsServer, w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			t.Errorf("request not TSIG signed: %v", w.TsigStatus())
+			m.SetRcode(r, dns.RcodeNotAuth)
+			w.WriteMsg(m)
+			return
+		}
+		switch {
+		case r.Opcode == dns.OpcodeUpdate:
+			s.mu.Lock()
+			s.updates = append(s.updates, r)
+			s.mu.Unlock()
+		case r.Question[0].Qtype == dns.TypeAXFR:
+			m.Answer = s.axfr
+		}
+		m.SetTsig(testTsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		w.WriteMsg(m)
+	}
+}
+
+func newTestRfc2136Provider(t *testing.T, s *testDnsServer) dnsProvider {
+	t.Helper()
+	rp, err := newRfc2136Provider(s.addr, testTsigName, testTsigSecret, "", []string{"dev5.lan", "2.1.10.in-addr.arpa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestRfc2136ApplyOneUpdatePerZone(t *testing.T) {
+	s := startTestDnsServer(t, testRfc2136Handler(t))
+	rp := newTestRfc2136Provider(t, s)
+	err := rp.Apply([]dnsChange{
+		{Zone: "dev5.lan", Type: "A", Name: "web-1.dev5.lan.", Content: "10.1.2.5", Ttl: 300},
+		{Zone: "2.1.10.in-addr.arpa", Type: "PTR", Name: "5.2.1.10.in-addr.arpa.", Content: "web-1.dev5.lan.", Ttl: 300},
+		{Zone: "dev5.lan", Type: "CNAME", Name: "old.dev5.lan.", Delete: true},
+		{Zone: "dev5.lan", Type: "A", Name: "web.dev5.lan.", Content: "10.1.2.5", Ttl: 60, Member: true},
+		{Zone: "dev5.lan", Type: "A", Name: "web.dev5.lan.", Content: "10.1.2.4", Ttl: 60, Member: true, Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.updates) != 2 {
+		t.Fatalf("got %d updates, want one per zone", len(s.updates))
+	}
+	forward, reverse := s.updates[0], s.updates[1]
+	if forward.Question[0].Name != "dev5.lan." || reverse.Question[0].Name != "2.1.10.in-addr.arpa." {
+		t.Fatalf("unexpected update zones %s, %s", forward.Question[0].Name, reverse.Question[0].Name)
+	}
+
+	want := []struct {
+		class  uint16
+		name   string
+		rrtype uint16
+		ttl    uint32
+		rdata  string
+	}{
+		// replace: RemoveRRset then Insert
+		{dns.ClassANY, "web-1.dev5.lan.", dns.TypeA, 0, ""},
+		{dns.ClassINET, "web-1.dev5.lan.", dns.TypeA, 300, "10.1.2.5"},
+		// delete: RemoveRRset
+		{dns.ClassANY, "old.dev5.lan.", dns.TypeCNAME, 0, ""},
+		// member changes: Insert, Remove
+		{dns.ClassINET, "web.dev5.lan.", dns.TypeA, 60, "10.1.2.5"},
+		{dns.ClassNONE, "web.dev5.lan.", dns.TypeA, 0, "10.1.2.4"},
+	}
+	if len(forward.Ns) != len(want) {
+		t.Fatalf("got %d update records, want %d: %v", len(forward.Ns), len(want), forward.Ns)
+	}
+	for i, rr := range forward.Ns {
+		hdr := rr.Header()
+		if hdr.Class != want[i].class || hdr.Name != want[i].name || hdr.Rrtype != want[i].rrtype || hdr.Ttl != want[i].ttl {
+			t.Errorf("record %d: got %s, want %s %d %s %s", i, rr, want[i].name, want[i].ttl, dns.ClassToString[want[i].class], dns.TypeToString[want[i].rrtype])
+		}
+		if want[i].rdata != "" && dnsRdata(rr) != want[i].rdata {
+			t.Errorf("record %d: got data %s, want %s", i, dnsRdata(rr), want[i].rdata)
+		}
+	}
+	if len(reverse.Ns) != 2 || reverse.Ns[0].Header().Class != dns.ClassANY || dnsRdata(reverse.Ns[1]) != "web-1.dev5.lan." {
+		t.Errorf("unexpected reverse update %v", reverse.Ns)
+	}
+}
+
+func TestRfc2136Records(t *testing.T) {
+	s := startTestDnsServer(t, testRfc2136Handler(t))
+	soa := testRR(t, "dev5.lan. 3600 IN SOA ns1.dev5.lan. hostmaster.dev5.lan. 1 3600 600 86400 60")
+	s.axfr = []dns.RR{
+		soa,
+		testRR(t, "web.dev5.lan. 60 IN A 10.1.2.4"),
+		testRR(t, "web.dev5.lan. 60 IN A 10.1.2.5"),
+		testRR(t, `_stackconf-a.web.dev5.lan. 60 IN TXT "heritage=stackconf,owner=web-1.dev5.lan,stack=dev5"`),
+		soa,
+	}
+	rp := newTestRfc2136Provider(t, s)
+	records, err := rp.Records("dev5.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dnsRecord{
+		{Name: "dev5.lan.", Type: "SOA", Content: "ns1.dev5.lan. hostmaster.dev5.lan. 1 3600 600 86400 60", Ttl: 3600},
+		{Name: "web.dev5.lan.", Type: "A", Content: "10.1.2.4", Ttl: 60},
+		{Name: "web.dev5.lan.", Type: "A", Content: "10.1.2.5", Ttl: 60},
+		{Name: "_stackconf-a.web.dev5.lan.", Type: "TXT", Content: `"heritage=stackconf,owner=web-1.dev5.lan,stack=dev5"`, Ttl: 60},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %v", len(records), len(want), records)
+	}
+	for i, record := range records {
+		if record != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, record, want[i])
+		}
+	}
+}
@@ -42,18 +42,24 @@ import (
 	"github.com/spf13/viper"
 )
 
+const stackconfVersion = "0.1.27"
+
 var cfgFile string
 var log = loggo.GetLogger("cmd")
 var httpClient = &http.Client{Timeout: time.Second * 10}
 var metaData map[string]interface{}
+var facterData map[string]interface{}
 var noop bool
 var noopMsg string
 var whitelist string
 var deleteDomains bool
+var matchUuid bool
 var onlyDNS bool
 var opposite bool
 var puppetVersion int
 var overriddenStackenv string
+var stackenv string
+var exitCode int
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -72,6 +78,9 @@ func Execute() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 }
 
 func init() {
@@ -92,6 +101,7 @@ func init() {
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	deleteenvCmd.Flags().StringVarP(&whitelist, "whitelist", "w", "", "Whitelisted entries not to be deleted, comma separated")
 	deleteenvCmd.Flags().BoolVarP(&deleteDomains, "deletedomains", "e", false, "Domains will be deleted based on input match")
+	deleteenvCmd.Flags().BoolVarP(&matchUuid, "uuid", "u", false, "Arguments are openstack instance uuids, matching foreman hosts are deleted")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -120,6 +130,18 @@ func initConfig() {
 	viper.SetDefault("stackconf.sources", []string{"openstackmeta", "puppetfacter"})
 	viper.SetDefault("puppet.config.runs", 3)
 	viper.SetDefault("puppet.config.runtimeout", 900)
+	viper.SetDefault("foreman.config.verify_ssl", true)
+	viper.SetDefault("foreman.config.timeout", 60)
+	viper.SetDefault("foreman.config.report", true)
+	viper.SetDefault("foreman.config.verify_timeout", 600)
+	viper.SetDefault("foreman.config.verify_interval", 15)
+	viper.SetDefault("foreman.host.interface.exclude", []string{"^lo$", "^docker"})
+	viper.SetDefault("dns.config.reverse.ipv4_prefix", 24)
+	viper.SetDefault("dns.config.reverse.ipv6_prefix", 64)
+	viper.SetDefault("dns.config.reverse.classless_cname", true)
+	viper.SetDefault("dns.config.verify_timeout", 300)
+	viper.SetDefault("dns.config.verify_interval", 5)
+	viper.SetDefault("dns.config.batch", true)
 	if _, err := os.Stat("/opt/puppetlabs/bin/puppet"); err == nil {
 		viper.SetDefault("puppet.version", 4)
 	} else {
@@ -188,6 +210,7 @@ func facter() (err error) {
 	}
 	// Map JSON and prepend it with puppetfacter key
 	m := facterdata.(map[string]interface{})
+	facterData = m
 	factermash, err := json.Marshal(puppetFacter{Puppetfacter: m})
 	if err != nil {
 		log.Debugf("Facter JSON prepend failed !")
@@ -344,6 +367,7 @@ func openstackMeta() (err error) {
 		}
 	}
 
+	stackenv = envStr
 	if envStr != "" {
 		log.Debugf("Did get stackenv variable, will set environment specific configuration fore environment: " + envStr)
 		envData := viper.Get("env." + envStr)
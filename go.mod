@@ -7,7 +7,6 @@ require (
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/Masterminds/sprig v2.22.0+incompatible
 	github.com/StackExchange/wmi v1.2.0 // indirect
-	github.com/cloudevelops/go-foreman v0.0.0-20200912182843-af317982fb5d
 	github.com/cloudevelops/go-powerdns v0.0.0-20190925183738-a52511e21ea4
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-ole/go-ole v1.2.5 // indirect
@@ -15,6 +14,7 @@ require (
 	github.com/huandu/xstrings v1.3.2 // indirect
 	github.com/imdario/mergo v0.3.12 // indirect
 	github.com/juju/loggo v0.0.0-20210708153607-abb62bf570b2
+	github.com/miekg/dns v1.1.43
 	github.com/mitchellh/copystructure v1.2.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/shirou/gopsutil v3.21.6+incompatible